@@ -4,6 +4,7 @@ go get github.com/gorilla/mux
 go get github.com/gorilla/websocket
 go get github.com/sirupsen/logrus
 go get github.com/lib/pq
+go get github.com/mattn/go-sqlite3
 
 GOOS=linux GOARCH=amd64 go build -o ticket_cache
 
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	log "github.com/sirupsen/logrus"
+	"github.com/tjgao/CachedTickets/fake12306"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func main() {
+	port := flag.Int("p", 8087, "Port to serve on")
+	mode := flag.String("mode", "normal", "how to answer: normal, empty, html, moved, slow or redirect; fake_mode=<mode> in a request overrides it")
+	entry := flag.String("entry", fake12306.DefaultQueryEntry, "the working ticket query entry, other leftTicket/query* entries get a c_url reply")
+	delay := flag.Duration("delay", 3*time.Second, "how long slow answers take")
+
+	flag.Parse()
+
+	m, err := fake12306.ParseMode(*mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := fake12306.New()
+	s.SetMode(m)
+	s.SetQueryEntry(*entry)
+	s.SetDelay(*delay)
+
+	log.Info("Fake 12306 starts up, serving http://localhost:", *port, "/otn/ in ", *mode, " mode")
+	err = http.ListenAndServe(":"+strconv.Itoa(*port), s)
+	if err != nil {
+		log.Fatal("Fail to start server: ", err)
+	}
+}
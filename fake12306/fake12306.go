@@ -0,0 +1,167 @@
+// Package fake12306 is a stand-in for the 12306 ticket api: it answers the left ticket and ticket price
+// queries from fixtures, and can be told to fail the ways 12306 does.
+package fake12306
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+type Mode int
+
+const (
+	// Normal answers from the fixtures
+	Normal Mode = iota
+	// EmptyBody answers 200 with nothing
+	EmptyBody
+	// HTMLError answers the html page 12306 shows when it is overloaded
+	HTMLError
+	// EntryMoved answers status:false with a c_url pointing at the working query entry
+	EntryMoved
+	// Slow answers from the fixtures after the delay
+	Slow
+	// Redirect answers 302 to the error page
+	Redirect
+)
+
+var modeNames = map[string]Mode{
+	"normal":   Normal,
+	"empty":    EmptyBody,
+	"html":     HTMLError,
+	"moved":    EntryMoved,
+	"slow":     Slow,
+	"redirect": Redirect,
+}
+
+// ParseMode turns the name of a mode (normal, empty, html, moved, slow or redirect) into a Mode.
+func ParseMode(name string) (Mode, error) {
+	if m, ok := modeNames[name]; ok {
+		return m, nil
+	}
+	return Normal, fmt.Errorf("unknown mode %s", name)
+}
+
+const (
+	DefaultQueryEntry = "leftTicket/query"
+	DefaultPriceEntry = "leftTicket/queryTicketPrice"
+)
+
+// Server serves the 12306 api below /otn/. Only the query entry it is set to works,
+// asking any other leftTicket/query* entry gets the c_url reply 12306 sends when the entry moved.
+// A request can pick its own mode with the fake_mode parameter, which wins over the server mode.
+type Server struct {
+	mu         sync.Mutex
+	mode       Mode
+	delay      time.Duration
+	queryEntry string
+	priceEntry string
+
+	requests int64
+}
+
+func New() *Server {
+	return &Server{
+		delay:      3 * time.Second,
+		queryEntry: DefaultQueryEntry,
+		priceEntry: DefaultPriceEntry,
+	}
+}
+
+// NewTestServer starts a Server on a local port, the upstream base url is the returned server's URL + "/otn/".
+func NewTestServer() (*httptest.Server, *Server) {
+	s := New()
+	return httptest.NewServer(s), s
+}
+
+func (s *Server) SetMode(m Mode) {
+	s.mu.Lock()
+	s.mode = m
+	s.mu.Unlock()
+}
+
+// SetDelay sets how long Slow answers take.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	s.delay = d
+	s.mu.Unlock()
+}
+
+// SetQueryEntry moves the working query entry, like 12306 does every now and then.
+func (s *Server) SetQueryEntry(entry string) {
+	s.mu.Lock()
+	s.queryEntry = entry
+	s.mu.Unlock()
+}
+
+// Requests returns how many api requests were served so far.
+func (s *Server) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := strings.TrimPrefix(r.URL.Path, "/otn/")
+	if entry == "error.html" {
+		s.serveFixture(w, "error.html", "text/html; charset=utf-8", nil)
+		return
+	}
+	atomic.AddInt64(&s.requests, 1)
+
+	s.mu.Lock()
+	mode, delay, queryEntry, priceEntry := s.mode, s.delay, s.queryEntry, s.priceEntry
+	s.mu.Unlock()
+
+	if name := r.URL.Query().Get("fake_mode"); name != "" {
+		if m, err := ParseMode(name); err == nil {
+			mode = m
+		}
+	}
+
+	switch mode {
+	case EmptyBody:
+		return
+	case HTMLError:
+		s.serveFixture(w, "error.html", "text/html; charset=utf-8", nil)
+		return
+	case Redirect:
+		http.Redirect(w, r, "/otn/error.html", http.StatusFound)
+		return
+	case Slow:
+		time.Sleep(delay)
+	}
+
+	switch {
+	case entry == priceEntry:
+		s.serveFixture(w, "ticket_price.json", "application/json;charset=UTF-8", nil)
+	case mode == EntryMoved || (entry != queryEntry && strings.HasPrefix(entry, "leftTicket/query")):
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		fmt.Fprintf(w, `{"status":false,"c_url":"%s","c_name":"CLeftTicketUrl"}`, queryEntry)
+	case entry == queryEntry:
+		date := r.URL.Query().Get("leftTicketDTO.train_date")
+		s.serveFixture(w, "left_tickets.json", "application/json;charset=UTF-8", strings.NewReplacer("{{date_compact}}", strings.Replace(date, "-", "", -1)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveFixture(w http.ResponseWriter, name, contentType string, replacer *strings.Replacer) {
+	b, err := fixtures.ReadFile("fixtures/" + name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if replacer != nil {
+		replacer.WriteString(w, string(b))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,44 @@
+package fake12306
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestModes(t *testing.T) {
+	ts, s := NewTestServer()
+	defer ts.Close()
+	query := ts.URL + "/otn/leftTicket/query?leftTicketDTO.train_date=2099-02-10&leftTicketDTO.from_station=BJP&leftTicketDTO.to_station=SHH&purpose_codes=ADULT"
+
+	if _, body := get(t, query); !strings.Contains(body, `"status":true`) || !strings.Contains(body, "20990210") {
+		t.Error("expected the left tickets fixture, got ", body)
+	}
+	if _, body := get(t, ts.URL+"/otn/leftTicket/queryTicketPrice?train_no=240000G1010I"); !strings.Contains(body, "¥933.0") {
+		t.Error("expected the ticket price fixture, got ", body)
+	}
+
+	s.SetQueryEntry("leftTicket/queryZ")
+	if _, body := get(t, query); body != `{"status":false,"c_url":"leftTicket/queryZ","c_name":"CLeftTicketUrl"}` {
+		t.Error("expected a c_url reply, got ", body)
+	}
+
+	s.SetMode(EmptyBody)
+	if _, body := get(t, query); body != "" {
+		t.Error("expected an empty body, got ", body)
+	}
+	if code, body := get(t, query+"&fake_mode=redirect"); code != http.StatusOK || !strings.Contains(body, "<html>") {
+		t.Error("expected to land on the error page, got ", code, body)
+	}
+}
@@ -0,0 +1,155 @@
+// Package fakeslave is an in-process slave for tests: it registers with a master over /ws/register
+// and fetches the urls it is asked for, or fails them the ways real slaves do.
+package fakeslave
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/tjgao/CachedTickets/ws"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Mode int
+
+const (
+	// Normal fetches the task url and answers with what it got
+	Normal Mode = iota
+	// Hang takes the task and never answers
+	Hang
+	// Disconnect drops the connection as soon as a task comes in
+	Disconnect
+	// Fail answers every task with FailedToAccessURL
+	Fail
+	// Unresponsive stops reading as soon as a task comes in, pings included, and keeps the connection open
+	// like a half-open peer
+	Unresponsive
+)
+
+// Slave is one connection to a master.
+type Slave struct {
+	conn   *websocket.Conn
+	client *http.Client
+
+	// gorilla connections take one writer at a time
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	mode Mode
+
+	tasks   int64
+	done    chan struct{}
+	closing chan struct{}
+	once    sync.Once
+}
+
+// Dial registers a new slave with the master serving at base, an http:// url like httptest.Server.URL.
+func Dial(base string) (*Slave, error) {
+	u := "ws" + strings.TrimPrefix(base, "http") + "/ws/register"
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Slave{
+		conn:    conn,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Slave) SetMode(m Mode) {
+	s.mu.Lock()
+	s.mode = m
+	s.mu.Unlock()
+}
+
+// Tasks returns how many tasks the slave was given so far.
+func (s *Slave) Tasks() int64 {
+	return atomic.LoadInt64(&s.tasks)
+}
+
+// Close drops the connection, the master sees the slave leave.
+func (s *Slave) Close() error {
+	s.once.Do(func() { close(s.closing) })
+	return s.conn.Close()
+}
+
+// Done is closed once the connection is gone.
+func (s *Slave) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Slave) run() {
+	defer close(s.done)
+	for {
+		t, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if t != websocket.BinaryMessage {
+			continue
+		}
+		var m ws.Message
+		if err = ws.Decode(data, &m); err != nil || m.ID != ws.TaskRequestType {
+			continue
+		}
+		var task ws.Task
+		if err = ws.DecodeTask(m.Body, &task); err != nil {
+			continue
+		}
+		atomic.AddInt64(&s.tasks, 1)
+
+		s.mu.Lock()
+		mode := s.mode
+		s.mu.Unlock()
+
+		switch mode {
+		case Hang:
+		case Disconnect:
+			s.conn.Close()
+			return
+		case Unresponsive:
+			<-s.closing
+			return
+		case Fail:
+			go s.reply(m.TransID, &ws.TaskResult{Code: ws.FailedToAccessURL, Description: "fake failure"})
+		default:
+			go s.do(m.TransID, task.TargetURL)
+		}
+	}
+}
+
+func (s *Slave) do(transID int64, url string) {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		s.reply(transID, &ws.TaskResult{Code: ws.FailedToAccessURL, Description: err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.reply(transID, &ws.TaskResult{Code: ws.FailedToReadFromResponse, Description: err.Error()})
+		return
+	}
+	s.reply(transID, &ws.TaskResult{Result: b, Code: ws.RetrieveDataSuccessfully})
+}
+
+func (s *Slave) reply(transID int64, tr *ws.TaskResult) {
+	body, err := ws.EncodeTaskResult(tr)
+	if err != nil {
+		return
+	}
+	b, err := ws.Encode(&ws.Message{ID: ws.TaskResultType, TransID: transID, Body: body})
+	if err != nil {
+		return
+	}
+	s.writeMu.Lock()
+	s.conn.WriteMessage(websocket.BinaryMessage, b)
+	s.writeMu.Unlock()
+}
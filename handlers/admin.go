@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	bts, err := json.Marshal(v)
+	if err != nil {
+		log.Error("failed to marshal a json object, err: ", err)
+		w.Write([]byte("{}"))
+	} else {
+		w.Write(bts)
+	}
+}
+
+// JanitorStatusHandler reports how many expired rows the janitor removed.
+func (env *AppEnv) JanitorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if env.Janitor == nil {
+		http.Error(w, "janitor is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, env.Janitor.Stats())
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tjgao/CachedTickets/ticketdata"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CachePolicy tells how long a stored result is served straight from the cache, without asking upstream.
+// A zero max age always asks upstream first, the cache then only covers upstream failures.
+// Past the max age, an entry is still served for the stale window while it gets refreshed in the background.
+type CachePolicy struct {
+	QueryMaxAge time.Duration
+	PriceMaxAge time.Duration
+
+	QueryStale time.Duration
+	PriceStale time.Duration
+}
+
+// values of the X-Cache header: MISS is live upstream data, HIT a cache entry within its max age,
+// STALE a cache entry past it (or served because upstream failed), ALTERNATIVE the tickets of another date of the same route.
+const (
+	cacheHitHeader         = "HIT"
+	cacheMissHeader        = "MISS"
+	cacheStaleHeader       = "STALE"
+	cacheAlternativeHeader = "ALTERNATIVE"
+)
+
+// the update time we inject in stored results, left out of etags so that a refresh bringing the same data keeps its etag
+var updateTimeField = regexp.MustCompile(`,?"updatetime":\d+`)
+
+func contentETag(content string) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(updateTimeField.ReplaceAllString(content, ""))))
+}
+
+// writeContent writes a json result along with its cache headers, or 304 if the client's copy is still current.
+// Live results are written the way they are stored, so that they get the etag of the cache entry they make.
+func writeContent(w http.ResponseWriter, r *http.Request, content string, updated time.Time, cacheStatus string) {
+	etag := contentETag(content)
+	age := int64(time.Since(updated) / time.Second)
+	if age < 0 {
+		age = 0
+	}
+
+	h := w.Header()
+	h.Set("X-Cache", cacheStatus)
+	h.Set("Age", strconv.FormatInt(age, 10))
+	h.Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	h.Set("ETag", etag)
+
+	if notModified(r, etag, updated) {
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(content))
+}
+
+// notModified checks the conditional headers, If-None-Match wins over If-Modified-Since as in RFC 7232.
+func notModified(r *http.Request, etag string, updated time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !updated.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+func (env *AppEnv) cacheState(updated time.Time, maxAge, stale time.Duration) cacheState {
+	if maxAge <= 0 {
+		return cacheMiss
+	}
+	age := time.Since(updated)
+	if age <= maxAge {
+		return cacheFresh
+	}
+	if env.Refresher != nil && age <= maxAge+stale {
+		return cacheStale
+	}
+	return cacheMiss
+}
+
+// serveCachedTickets writes the stored left tickets of t if the policy allows skipping upstream,
+// refreshing them in the background when they are stale.
+// Alternative tickets of another date never count.
+func (env *AppEnv) serveCachedTickets(w http.ResponseWriter, r *http.Request, t *ticketdata.TicketEntity, codes string) bool {
+	if env.Policy.QueryMaxAge <= 0 {
+		return false
+	}
+	c := *t
+	if _, err := env.Db.GetLeftTickets(&c); err != nil || c.Date != t.Date {
+		return false
+	}
+
+	switch env.cacheState(c.UpdateTime, env.Policy.QueryMaxAge, env.Policy.QueryStale) {
+	case cacheFresh:
+		writeContent(w, r, c.Content, c.UpdateTime, cacheHitHeader)
+	case cacheStale:
+		atomic.AddInt64(&env.stats.StaleServed, 1)
+		env.Refresher.Submit(env.ticketsURL(t.Date, t.From, t.To, codes), func() { env.refreshTickets(t, codes) })
+		writeContent(w, r, c.Content, c.UpdateTime, cacheStaleHeader)
+	default:
+		return false
+	}
+	return true
+}
+
+// serveCachedTicketPrice is serveCachedTickets for ticket prices.
+func (env *AppEnv) serveCachedTicketPrice(w http.ResponseWriter, r *http.Request, t *ticketdata.TicketPriceEntity, date string) bool {
+	if env.Policy.PriceMaxAge <= 0 {
+		return false
+	}
+	c := *t
+	if _, err := env.Db.GetTicketPrice(&c); err != nil {
+		return false
+	}
+
+	switch env.cacheState(c.UpdateTime, env.Policy.PriceMaxAge, env.Policy.PriceStale) {
+	case cacheFresh:
+		writeContent(w, r, c.Content, c.UpdateTime, cacheHitHeader)
+	case cacheStale:
+		atomic.AddInt64(&env.stats.StaleServed, 1)
+		env.Refresher.Submit(env.ticketPriceURL(t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes, date), func() { env.refreshTicketPrice(t, date) })
+		writeContent(w, r, c.Content, c.UpdateTime, cacheStaleHeader)
+	default:
+		return false
+	}
+	return true
+}
+
+func (env *AppEnv) refreshTickets(t *ticketdata.TicketEntity, codes string) {
+	res := env.fetchTicketsFollowing(t.Date, t.From, t.To, codes)
+	js, err := verifyTickets(&res)
+	if err != nil {
+		log.Warn("background refresh got invalid ticket json: ", t.From, "-", t.To, " ", t.Date, " ", err)
+		return
+	}
+	e := ticketdata.TicketEntity{From: t.From, To: t.To, Date: t.Date, UpdateTime: time.Now()}
+	if err = env.saveTicketsToDB(&e, js); err != nil {
+		log.Warn("failed to write refreshed data into db: ", err)
+		return
+	}
+	atomic.AddInt64(&env.stats.Refreshed, 1)
+}
+
+func (env *AppEnv) refreshTicketPrice(t *ticketdata.TicketPriceEntity, date string) {
+	res := string(env.fetchTicketPrice(make(chan []byte, 1), t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes, date))
+	js, err := verifyTicketPrice(&res)
+	if err != nil || emptyTicketPriceJSON(js) {
+		log.Warn("background refresh got no ticket price: ", t.TrainNo, " ", t.FromStationNo, "-", t.ToStationNo, " ", err)
+		return
+	}
+	e := ticketdata.TicketPriceEntity{TrainNo: t.TrainNo, FromStationNo: t.FromStationNo, ToStationNo: t.ToStationNo, SeatTypes: t.SeatTypes, UpdateTime: time.Now()}
+	if err = env.saveTicketPriceToDB(&e, js); err != nil {
+		log.Warn("failed to write refreshed price into db: ", err)
+		return
+	}
+	atomic.AddInt64(&env.stats.Refreshed, 1)
+}
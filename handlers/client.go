@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientConfig is how master talks to upstream. Zero durations and sizes take the defaults below.
+type ClientConfig struct {
+	// whole request, body included
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	// how long an idle keep-alive connection is kept in the pool
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+
+	// pem file of CA certificates trusted on top of the system ones
+	CABundle string
+	// http://, https:// or socks5:// url of an outbound proxy, empty to go direct
+	Proxy string
+	// skip certificate verification, only ever meant for testing
+	Insecure bool
+}
+
+// DefaultClientConfig keeps a handful of connections open to each upstream.
+var DefaultClientConfig = ClientConfig{
+	Timeout:             15 * time.Second,
+	DialTimeout:         5 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConnsPerHost: 8,
+}
+
+var defaultClient, _ = NewClient(DefaultClientConfig)
+
+// NewClient builds the long-lived client upstream fetches share, so that connections are reused across requests.
+func NewClient(cfg ClientConfig) (*http.Client, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultClientConfig.Timeout
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = DefaultClientConfig.DialTimeout
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = DefaultClientConfig.IdleConnTimeout
+	}
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = DefaultClientConfig.MaxIdleConnsPerHost
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CABundle != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: cfg.DialTimeout,
+		MaxIdleConns:        cfg.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, errors.New("unsupported proxy scheme " + u.Scheme)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: tr, Timeout: cfg.Timeout}, nil
+}
+
+func (env *AppEnv) client() *http.Client {
+	if env.Client != nil {
+		return env.Client
+	}
+	return defaultClient
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+)
+
+type flight struct {
+	done   chan struct{}
+	result []byte
+	dups   int
+}
+
+// flightGroup lets concurrent requests for the same upstream url share a single fetch.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// do runs fn for url unless a call for the same url is already in flight, in which case it waits for that one.
+// shared tells whether the result came from another caller's fetch.
+func (g *flightGroup) do(url string, fn func() []byte) (result []byte, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flight)
+	}
+	if f, ok := g.m[url]; ok {
+		f.dups++
+		g.mu.Unlock()
+		<-f.done
+		return f.result, true
+	}
+	f := &flight{done: make(chan struct{})}
+	g.m[url] = f
+	g.mu.Unlock()
+
+	f.result = fn()
+
+	g.mu.Lock()
+	delete(g.m, url)
+	dups := f.dups
+	g.mu.Unlock()
+	close(f.done)
+
+	if dups > 0 {
+		log.Info("upstream fetch shared by ", dups+1, " requests: ", url)
+	}
+	return f.result, false
+}
+
+// fetch asks upstream for url and sends the result on ch. Identical requests running at the same time share one fetch.
+// validate, if not nil, tells the answers worth keeping from the ones worth retrying.
+func (env *AppEnv) fetch(ch chan []byte, url string, validate func([]byte) error) []byte {
+	result, shared := env.flights.do(url, func() []byte {
+		atomic.AddInt64(&env.stats.UpstreamFetches, 1)
+		return env.grab12306(make(chan []byte, 1), url, validate)
+	})
+	if shared {
+		atomic.AddInt64(&env.stats.Coalesced, 1)
+		log.Debug("coalesced upstream request: ", url)
+	}
+	ch <- result
+	return result
+}
@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +18,55 @@ import (
 type AppEnv struct {
 	Db  ticketdata.TicketInfo
 	Ctx *ws.WSContext
+
+	// History keeps snapshots of the saved left tickets, nil if disabled
+	History *ticketdata.History
+
+	// Janitor purges expired tickets, nil if disabled
+	Janitor *ticketdata.Janitor
+
+	// Policy decides when the cache is good enough to skip upstream
+	Policy CachePolicy
+
+	// Refresher updates stale entries in the background, nil serves stale entries as misses
+	Refresher *Refresher
+
+	// Warmer fetches planned routes ahead of the clients, nil if disabled
+	Warmer *Warmer
+
+	// Popularity counts the queries per route and price, nil if disabled
+	Popularity *Popularity
+
+	// APIFile keeps the 12306 entries across restarts, empty if they are not persisted
+	APIFile string
+
+	// Prober looks for working 12306 entries in the background, nil if disabled
+	Prober *Prober
+
+	// Upstreams are asked in order until one answers, the official 12306 site if empty
+	Upstreams []Upstream
+
+	// Recorder saves every upstream exchange, Replayer answers from saved ones instead of asking upstream
+	Recorder *Recorder
+	Replayer *Replayer
+
+	// Client fetches from upstream, a pooled client verifying certificates if nil
+	Client *http.Client
+
+	// Session keeps cookies and browser headers for master fetches, nil sends bare requests
+	Session *Session
+
+	// Retry is how many slaves are tried before giving up on a fetch
+	Retry RetryPolicy
+
+	// Hedge sends slow slave tasks to a second slave
+	Hedge HedgePolicy
+
+	// Timeout bounds how long a client waits for upstream before being served from the cache, 10s if zero
+	Timeout time.Duration
+
+	flights flightGroup
+	stats   appStats
 }
 
 type urlChangeMsg struct {
@@ -66,6 +115,28 @@ func init() {
 	shared_api = &api12306{queryEntryDefault, priceEntryDefault}
 }
 
+// currentAPI returns the entries in use, shared_api is swapped atomically when they change
+func currentAPI() *api12306 {
+	return (*api12306)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&shared_api))))
+}
+
+func swapAPI(t *api12306) *api12306 {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&shared_api))
+	return (*api12306)(atomic.SwapPointer(p, unsafe.Pointer(t)))
+}
+
+func casAPI(old, t *api12306) bool {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&shared_api))
+	return atomic.CompareAndSwapPointer(p, unsafe.Pointer(old), unsafe.Pointer(t))
+}
+
+func (env *AppEnv) timeout() time.Duration {
+	if env.Timeout > 0 {
+		return env.Timeout
+	}
+	return 10 * time.Second
+}
+
 func getQueryParam(r *http.Request, name string) string {
 	value, existed := r.Form[name]
 	if !existed {
@@ -75,18 +146,27 @@ func getQueryParam(r *http.Request, name string) string {
 	return value[0]
 }
 
-func grab12306L(ch chan []byte, url string) []byte {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
+// grab12306L has master fetch url, giving up once ctx is done
+func (env *AppEnv) grab12306L(ctx context.Context, ch chan []byte, url string) []byte {
 	var result []byte
-	client := &http.Client{Transport: tr}
-	resp, err := client.Get(url)
+	status := 0
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	if env.Session != nil {
+		resp, err = env.Session.Get(ctx, env.client(), env.baseOf(url), url)
+	} else {
+		var req *http.Request
+		if req, err = http.NewRequest("GET", url, nil); err == nil {
+			resp, err = env.client().Do(req.WithContext(ctx))
+		}
+	}
 	if err != nil {
 		log.Error("Failed to access url: ", err)
 	} else {
-		b, err := ioutil.ReadAll(resp.Body)
+		status = resp.StatusCode
+		var b []byte
+		b, err = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 
 		if err != nil {
@@ -95,33 +175,26 @@ func grab12306L(ch chan []byte, url string) []byte {
 
 		result = b
 	}
+	env.record(url, "master", start, status, err, result)
 	ch <- result
 	return result
 }
 
-func (env *AppEnv) grab12306(ch chan []byte, url string) []byte {
+func (env *AppEnv) grab12306(ch chan []byte, url string, validate func([]byte) error) []byte {
+	if env.Replayer != nil {
+		ret := env.Replayer.Replay(url)
+		ch <- ret
+		return ret
+	}
+	// the client stops waiting after env.timeout(), so should we
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
 	if env.Ctx != nil {
-		// find a slave
-		// if returned slave is nil, that means we are using master
-		var ret []byte
-		slave := env.Ctx.GetOneSlave()
-		if slave != nil {
-			result, err := slave.DoTask(url)
-			if err != nil {
-				ch <- nil
-			} else if result != nil {
-				ret = result.Result
-				ch <- ret
-			}
-			return ret
-		}
-		log.Debug("master takes the request: ", url)
+		ret := env.grabWithRetry(ctx, url, validate)
+		ch <- ret
+		return ret
 	}
-	return grab12306L(ch, url)
-}
-
-func (env *AppEnv) UpdateCacheHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info("updateCacheHandler")
+	return env.grab12306L(ctx, ch, url)
 }
 
 func (env *AppEnv) ShowWorkingHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +202,8 @@ func (env *AppEnv) ShowWorkingHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *AppEnv) Current12306APIHandler(w http.ResponseWriter, r *http.Request) {
-	json := fmt.Sprintf(`{"ticket":"%s", "price":"%s"}`, shared_api.queryEntry, shared_api.priceEntry)
+	api := currentAPI()
+	json := fmt.Sprintf(`{"ticket":"%s", "price":"%s"}`, api.queryEntry, api.priceEntry)
 	w.Write([]byte(json))
 }
 
@@ -141,9 +215,7 @@ func (env *AppEnv) Update12306APIHandler(w http.ResponseWriter, r *http.Request)
 		if len(query)*len(price) == 0 {
 			w.Write([]byte(`Not enough params`))
 		} else {
-			t := &api12306{query, price}
-			p := (*unsafe.Pointer)(unsafe.Pointer(&shared_api))
-			atomic.SwapPointer(p, unsafe.Pointer(t))
+			env.setAPI(&api12306{query, price})
 			w.Write([]byte(`OK`))
 		}
 	} else {
@@ -223,12 +295,13 @@ func (env *AppEnv) saveTicketPriceToDB(t *ticketdata.TicketPriceEntity, js *tick
 	return env.Db.SaveTicketPrice(t)
 }
 
-func (env *AppEnv) getTicketPriceFromDB(w http.ResponseWriter, t *ticketdata.TicketPriceEntity) error {
+func (env *AppEnv) getTicketPriceFromDB(w http.ResponseWriter, r *http.Request, t *ticketdata.TicketPriceEntity) error {
 	_, err := env.Db.GetTicketPrice(t)
 	if err != nil {
+		w.Header().Set("X-Cache", cacheMissHeader)
 		w.Write([]byte(`{"isempty":1}`))
 	} else {
-		w.Write([]byte(t.Content))
+		writeContent(w, r, t.Content, t.UpdateTime, cacheStaleHeader)
 	}
 	return err
 }
@@ -275,15 +348,20 @@ func (env *AppEnv) QueryTicketPriceHandler(w http.ResponseWriter, r *http.Reques
 		log.Warn("No enough params")
 		w.Write([]byte("{}"))
 	} else {
-		url := "https://kyfw.12306.cn/otn/" + shared_api.priceEntry + "?train_no=" + trainNo +
-			"&from_station_no=" + from + "&to_station_no=" + to + "&seat_types=" + seatType +
-			"&train_date=" + date
+		if env.Popularity != nil {
+			env.Popularity.recordPrice(trainNo, from, to, seatType, date)
+		}
+		url := env.ticketPriceURL(trainNo, from, to, seatType, date)
+		if env.serveCachedTicketPrice(w, r, &t, date) {
+			log.Debug("ticket price served from cache: ", url)
+			return
+		}
 
-		ch := make(chan []byte)
+		ch := make(chan []byte, 1)
 
 		log.Debug("request ticket price -> " + url)
 
-		go env.grab12306(ch, url)
+		go env.fetchTicketPrice(ch, trainNo, from, to, seatType, date)
 
 		select {
 		case b := <-ch:
@@ -291,14 +369,19 @@ func (env *AppEnv) QueryTicketPriceHandler(w http.ResponseWriter, r *http.Reques
 			js, err := verifyTicketPrice(&res)
 			if err != nil {
 				log.Error("failed to verify ticket price json, ", res, err)
-				env.getTicketPriceFromDB(w, &t)
+				env.getTicketPriceFromDB(w, r, &t)
 			} else {
-				w.Write([]byte(res))
 				if !emptyTicketPriceJSON(js) {
-					env.saveTicketPriceToDB(&t, js)
+					if err = env.saveTicketPriceToDB(&t, js); err != nil {
+						log.Warn("failed to write data into db: ", err)
+					}
+				}
+				if t.Content != "" {
+					res = t.Content
 				}
+				writeContent(w, r, res, time.Now(), cacheMissHeader)
 			}
-		case <-time.After(time.Second * 10):
+		case <-time.After(env.timeout()):
 			w.Write([]byte("{\"result\":\"timeout\"}"))
 		}
 	}
@@ -327,16 +410,26 @@ func (env *AppEnv) saveTicketsToDB(t *ticketdata.TicketEntity, js *leftTicketsJS
 		return err
 	}
 	t.Content = string(bs)
-	return env.Db.SaveLeftTickets(t)
+	err = env.Db.SaveLeftTickets(t)
+	if err == nil && env.History != nil {
+		if e := env.History.Record(t); e != nil {
+			log.Warn("failed to record ticket snapshot: ", e)
+		}
+	}
+	return err
 }
 
-func (env *AppEnv) getTicketsFromDB(w http.ResponseWriter, t *ticketdata.TicketEntity) error {
+func (env *AppEnv) getTicketsFromDB(w http.ResponseWriter, r *http.Request, t *ticketdata.TicketEntity) error {
+	date := t.Date
 	_, err := env.Db.GetLeftTickets(t)
 	if err != nil {
 		log.Error("failed to get tickets from db: ", err)
+		w.Header().Set("X-Cache", cacheMissHeader)
 		w.Write([]byte(`{"isempty":1}`))
+	} else if t.Date != date {
+		writeContent(w, r, t.Content, t.UpdateTime, cacheAlternativeHeader)
 	} else {
-		w.Write([]byte(t.Content))
+		writeContent(w, r, t.Content, t.UpdateTime, cacheStaleHeader)
 	}
 	return err
 }
@@ -354,75 +447,53 @@ func (env *AppEnv) QueryHandler(w http.ResponseWriter, r *http.Request) {
 		log.Warn("no enough params")
 		w.Write([]byte("Error, no enough params"))
 	} else {
-		url := "https://kyfw.12306.cn/otn/" + shared_api.queryEntry + "?leftTicketDTO.train_date=" +
-			date + "&leftTicketDTO.from_station=" + from + "&leftTicketDTO.to_station=" +
-			to + "&purpose_codes=" + codes
+		if env.Popularity != nil {
+			env.Popularity.recordQuery(from, to, date, codes)
+		}
+		url := env.ticketsURL(date, from, to, codes)
+		if env.serveCachedTickets(w, r, &t, codes) {
+			log.Debug("train info served from cache: ", url)
+			return
+		}
 
-		ch := make(chan []byte)
+		ch := make(chan []byte, 1)
 
 		log.Debug("request train info -> " + url)
-		go env.grab12306(ch, url)
+		go env.fetchTickets(ch, date, from, to, codes)
 
+		timeout := time.After(env.timeout())
 		select {
 		case b := <-ch:
 			res := string(b)
 			js, e := verifyTickets(&res)
+			if e != nil && env.followEntryChange(res) {
+				// 12306 moved the query entry, ask again at the new one within what is left of the timeout
+				log.Debug("request train info again -> " + env.ticketsURL(date, from, to, codes))
+				go env.fetchTickets(ch, date, from, to, codes)
+				select {
+				case b = <-ch:
+					res = string(b)
+					js, e = verifyTickets(&res)
+				case <-timeout:
+					e = errors.New("timeout while following the query entry change")
+				}
+			}
 			if e != nil {
 				log.Error("ticket json is invalid: ", res, e)
-				env.getTicketsFromDB(w, &t)
+				env.getTicketsFromDB(w, r, &t)
 			} else {
-				w.Write([]byte(res))
 				e = env.saveTicketsToDB(&t, js)
 				if e != nil {
 					log.Warn("failed to write data into db: ", e)
 				}
-			}
-			/*
-				log.Info(res)
-				msg := new(urlChangeMsg)
-				err := json.Unmarshal([]byte(res), &msg)
-				if err != nil {
-					env.getTicketsFromDB(w, &t)
-					return
+				if t.Content != "" {
+					res = t.Content
 				}
-				if !msg.Status && len(msg.URL) > 0 {
-					newurl := "https://kyfw.12306.cn/otn/" + msg.URL + "?leftTicketDTO.train_date=" +
-						date + "&leftTicketDTO.from_station=" + from + "&leftTicketDTO.to_station=" +
-						to + "&purpose_codes=" + codes
-
-					newch := make(chan []byte)
-					go env.grab12306(newch, newurl)
-					select {
-					case nb := <-newch:
-						newres := string(nb)
-						js, e := verifyTickets(&newres)
-						if e != nil {
-							env.getTicketsFromDB(w, &t)
-						} else {
-							w.Write([]byte(newres))
-							env.saveTicketsToDB(&t, js)
-						}
-					case <-time.After(time.Second * 10):
-						log.Warn("Timeout !")
-						env.getTicketsFromDB(w, &t)
-					}
-
-				} else {
-					js, e := verifyTickets(&res)
-					if e != nil {
-						env.getTicketsFromDB(w, &t)
-					} else {
-						w.Write([]byte(res))
-						e = env.saveTicketsToDB(&t, js)
-						if e != nil {
-							log.Warn("failed to write data into db: ", e)
-						}
-					}
-				}
-			*/
-		case <-time.After(time.Second * 10):
+				writeContent(w, r, res, time.Now(), cacheMissHeader)
+			}
+		case <-timeout:
 			log.Warn("Timeout !")
-			env.getTicketsFromDB(w, &t)
+			env.getTicketsFromDB(w, r, &t)
 		}
 	}
 }
@@ -1,7 +1,20 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/tjgao/CachedTickets/fake12306"
+	"github.com/tjgao/CachedTickets/ticketdata"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestEmptyTicketPriceJSON(t *testing.T) {
@@ -30,3 +43,741 @@ func TestEmptyTicketPriceJSON(t *testing.T) {
 		t.Error("Non-empty ticket price json considered empty")
 	}
 }
+
+func TestQueryServesFreshCache(t *testing.T) {
+	db := ticketdata.NewMemDB()
+	db.SaveLeftTickets(&ticketdata.TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10", Content: `{"status":true}`})
+	env := &AppEnv{Db: db, Policy: CachePolicy{QueryMaxAge: time.Minute}}
+
+	r := httptest.NewRequest("GET", "/query?leftTicketDTO.train_date=2099-02-10&leftTicketDTO.from_station=BJP&leftTicketDTO.to_station=SHH&purpose_codes=ADULT", nil)
+	w := httptest.NewRecorder()
+	env.QueryHandler(w, r)
+
+	if w.Body.String() != `{"status":true}` {
+		t.Error("expected the cached entry, got ", w.Body.String())
+	}
+	if w.Header().Get("X-Cache") != cacheHitHeader || w.Header().Get("ETag") == "" {
+		t.Error("expected cache headers, got ", w.Header())
+	}
+
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	env.QueryHandler(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Error("expected 304 for a matching etag, got ", w.Code, w.Body.String())
+	}
+}
+
+func TestQueryRefreshesStaleCache(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, fake := fake12306.NewTestServer()
+	defer ts.Close()
+
+	db := ticketdata.NewMemDB()
+	db.SaveLeftTickets(&ticketdata.TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10", Content: `{"status":true}`})
+	env := &AppEnv{
+		Db:        db,
+		Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")},
+		Policy:    CachePolicy{QueryMaxAge: 50 * time.Millisecond, QueryStale: time.Minute},
+		Refresher: NewRefresher(1, 4),
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	r := httptest.NewRequest("GET", "/query?leftTicketDTO.train_date=2099-02-10&leftTicketDTO.from_station=BJP&leftTicketDTO.to_station=SHH&purpose_codes=ADULT", nil)
+	w := httptest.NewRecorder()
+	env.QueryHandler(w, r)
+	if w.Body.String() != `{"status":true}` || w.Header().Get("X-Cache") != cacheStaleHeader {
+		t.Error("expected the stale entry, got ", w.Header().Get("X-Cache"), " ", w.Body.String())
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		c := ticketdata.TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10"}
+		db.GetLeftTickets(&c)
+		if _, err := verifyTickets(&c.Content); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the background refresh to update the entry, got ", c.Content)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fake.Requests() != 1 {
+		t.Error("expected one upstream request, got ", fake.Requests())
+	}
+}
+
+func TestPopularityEvictsColdest(t *testing.T) {
+	p, _ := NewPopularity(time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		p.recordQuery("BJP", "SHH", "2099-02-10", "ADULT")
+	}
+	p.recordQuery("BJP", "GZQ", "2099-02-10", "ADULT")
+	p.recordQuery("BJP", "GZQ", "2099-02-10", "ADULT")
+	p.recordQuery("BJP", "CDW", "2099-02-10", "ADULT")
+
+	top := p.Top(10, "")
+	if len(top) != 2 || top[0].To != "SHH" || top[1].To != "CDW" {
+		t.Error("expected the coldest entry to make room, got ", top)
+	}
+
+	// hits move an entry away from eviction
+	for i := 0; i < 3; i++ {
+		p.recordQuery("BJP", "CDW", "2099-02-10", "ADULT")
+	}
+	p.recordQuery("BJP", "WHN", "2099-02-10", "ADULT")
+	top = p.Top(10, "")
+	if len(top) != 2 || top[0].To != "CDW" || top[1].To != "WHN" {
+		t.Error("expected the now coldest entry to make room, got ", top)
+	}
+
+	if _, err := NewPopularity(0, 2); err == nil {
+		t.Error("expected a zero half life to be refused")
+	}
+}
+
+func TestRefresherSubmit(t *testing.T) {
+	r := NewRefresher(1, 1)
+	started := make(chan bool)
+	release := make(chan bool)
+	if !r.Submit("a", func() { started <- true; <-release }) {
+		t.Fatal("expected the first job to be queued")
+	}
+	<-started
+
+	if r.Submit("a", func() {}) {
+		t.Error("expected a key already pending to be refused")
+	}
+	if !r.Submit("b", func() {}) {
+		t.Error("expected the job to wait in the queue")
+	}
+	if r.Submit("c", func() {}) {
+		t.Error("expected the job to be dropped with the queue full")
+	}
+	close(release)
+
+	// once the queue drains, neither the finished key nor the dropped one is held back
+	deadline := time.Now().Add(time.Second)
+	for !r.Submit("a", func() {}) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the finished key to be accepted again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for !r.Submit("c", func() {}) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the dropped key to be accepted again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveAndCachedShareETag(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, _ := fake12306.NewTestServer()
+	defer ts.Close()
+
+	env := &AppEnv{Db: ticketdata.NewMemDB(), Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}, Policy: CachePolicy{QueryMaxAge: time.Minute}}
+	r := httptest.NewRequest("GET", "/query?leftTicketDTO.train_date=2099-02-10&leftTicketDTO.from_station=BJP&leftTicketDTO.to_station=SHH&purpose_codes=ADULT", nil)
+	w := httptest.NewRecorder()
+	env.QueryHandler(w, r)
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("X-Cache") != cacheMissHeader || etag == "" {
+		t.Fatal("expected live tickets, got ", w.Header())
+	}
+
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	env.QueryHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Error("expected the etag of the live answer to match the cached one, got ", w.Code, " ", w.Header().Get("ETag"), " for ", etag)
+	}
+
+	// a refresh bringing the same tickets keeps the etag
+	if contentETag(`{"status":true,"updatetime":1}`) != contentETag(`{"status":true,"updatetime":2}`) {
+		t.Error("expected the update time to be left out of the etag")
+	}
+}
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var g flightGroup
+	var calls int64
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do("url", func() []byte {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				return []byte("result")
+			})
+		}(i)
+	}
+	// let every goroutine join the flight before it lands
+	for {
+		g.mu.Lock()
+		f := g.m["url"]
+		joined := f != nil && f.dups == len(results)-1
+		g.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("expected a single upstream call, got ", calls)
+	}
+	for _, r := range results {
+		if string(r) != "result" {
+			t.Error("expected every caller to get the shared result, got ", string(r))
+		}
+	}
+}
+
+func TestPopularityTop(t *testing.T) {
+	p, _ := NewPopularity(time.Hour, 0)
+	for i := 0; i < 3; i++ {
+		p.recordQuery("BJP", "SHH", "2099-02-10", "ADULT")
+	}
+	p.recordQuery("BJP", "GZQ", "2099-02-10", "ADULT")
+	p.recordPrice("760000D63803", "01", "05", "OM9", "2099-02-10")
+
+	top := p.Top(1, popularQuery)
+	if len(top) != 1 || top[0].To != "SHH" || top[0].Score < 2.9 {
+		t.Error("expected the most queried route first, got ", top)
+	}
+	if all := p.Top(10, ""); len(all) != 3 {
+		t.Error("expected every entry, got ", all)
+	}
+
+	// an hour later the counts are halved
+	p.mu.Lock()
+	for _, e := range p.entries {
+		e.Updated = e.Updated.Add(-time.Hour)
+	}
+	p.mu.Unlock()
+	if top = p.Top(1, popularQuery); top[0].Score > 1.6 {
+		t.Error("expected the score to decay, got ", top[0].Score)
+	}
+}
+
+func TestFollowEntryChange(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	env := &AppEnv{}
+	if env.followEntryChange(`{"status":true,"httpstatus":200}`) {
+		t.Error("a valid answer is not an entry change")
+	}
+	if env.followEntryChange(`{"status":false,"c_url":"http://evil/queryZ"}`) {
+		t.Error("entry outside of leftTicket/ should be ignored")
+	}
+	if isEntryChange([]byte(`{"status":false,"c_url":"http://evil/queryZ"}`)) {
+		t.Error("a c_url we would not follow is not a final answer")
+	}
+	if !isEntryChange([]byte(`{"status":false,"c_url":"leftTicket/queryZ"}`)) {
+		t.Error("expected a c_url to leftTicket/ to be a final answer")
+	}
+	if !env.followEntryChange(`{"status":false,"c_url":"leftTicket/queryZ","c_name":"CLeftTicketUrl"}`) {
+		t.Fatal("expected the entry change to be followed")
+	}
+	if api := currentAPI(); api.queryEntry != "leftTicket/queryZ" || api.priceEntry != priceEntryDefault {
+		t.Error("unexpected entries after the change: ", api)
+	}
+}
+
+func TestUpdateAPIKeepsConcurrentSwitch(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	env := &AppEnv{}
+	calls := 0
+	env.updateAPI(func(a api12306) api12306 {
+		calls++
+		if calls == 1 {
+			// the price entry is switched while the query entry change is on its way
+			env.setAPI(&api12306{a.queryEntry, "leftTicket/queryTicketPriceFL"})
+		}
+		return api12306{"leftTicket/queryZ", a.priceEntry}
+	})
+	if api := currentAPI(); api.queryEntry != "leftTicket/queryZ" || api.priceEntry != "leftTicket/queryTicketPriceFL" || calls != 2 {
+		t.Error("expected both switches to be kept, got ", api, " after ", calls, " tries")
+	}
+}
+
+func TestWarmFollowsEntryChange(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, fake := fake12306.NewTestServer()
+	defer ts.Close()
+	fake.SetQueryEntry("leftTicket/queryA")
+
+	db := ticketdata.NewMemDB()
+	env := &AppEnv{Db: db, Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}}
+	wm := NewWarmer(env, 0)
+	if err := wm.warm(warmTask{from: "BJP", to: "SHH", date: "2099-02-10", codes: "ADULT"}); err != nil {
+		t.Fatal("expected the warm-up to follow the moved entry, got ", err)
+	}
+	if currentAPI().queryEntry != "leftTicket/queryA" {
+		t.Error("expected the query entry to follow the change, got ", currentAPI().queryEntry)
+	}
+	c := ticketdata.TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10"}
+	if _, err := db.GetLeftTickets(&c); err != nil || c.Date != "2099-02-10" {
+		t.Error("expected the warmed tickets to be saved, got ", c.Date, err)
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>error</html>"))
+	}))
+	defer broken.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"httpstatus":200,"status":true,"data":{"flag":"1","result":[]}}`))
+	}))
+	defer mirror.Close()
+
+	env := &AppEnv{Upstreams: []Upstream{NewRail12306(broken.URL), NewRail12306(mirror.URL + "/otn")}}
+	res := string(env.fetchTickets(make(chan []byte, 1), "2099-02-10", "BJP", "SHH", "ADULT"))
+	if _, err := verifyTickets(&res); err != nil {
+		t.Error("expected the mirror to take over, got ", res)
+	}
+}
+
+func TestQueryFollowsEntryChange(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, fake := fake12306.NewTestServer()
+	defer ts.Close()
+	fake.SetQueryEntry("leftTicket/queryA")
+
+	env := &AppEnv{Db: ticketdata.NewMemDB(), Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}}
+	r := httptest.NewRequest("GET", "/query?leftTicketDTO.train_date=2099-02-10&leftTicketDTO.from_station=BJP&leftTicketDTO.to_station=SHH&purpose_codes=ADULT", nil)
+	w := httptest.NewRecorder()
+	env.QueryHandler(w, r)
+
+	res := w.Body.String()
+	if _, err := verifyTickets(&res); err != nil || w.Header().Get("X-Cache") != cacheMissHeader {
+		t.Error("expected live tickets from the moved entry, got ", res, err)
+	}
+	if currentAPI().queryEntry != "leftTicket/queryA" {
+		t.Error("expected the query entry to follow the change, got ", currentAPI().queryEntry)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	ts, fake := fake12306.NewTestServer()
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &AppEnv{Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}, Recorder: rec}
+	recorded := env.fetchTickets(make(chan []byte, 1), "2099-02-10", "BJP", "SHH", "ADULT")
+	ts.Close()
+
+	rp, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env = &AppEnv{Upstreams: []Upstream{NewRail12306("https://mirror.invalid/otn/")}, Replayer: rp}
+	for i := 0; i < 2; i++ {
+		replayed := env.fetchTickets(make(chan []byte, 1), "2099-02-10", "BJP", "SHH", "ADULT")
+		if string(replayed) != string(recorded) {
+			t.Error("expected the recorded tickets, got ", string(replayed))
+		}
+	}
+	if fake.Requests() != 1 {
+		t.Error("expected one upstream request, got ", fake.Requests())
+	}
+}
+
+func TestClientVerifiesCertificates(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	env := &AppEnv{}
+	if res := env.grab12306L(context.Background(), make(chan []byte, 1), ts.URL); res != nil {
+		t.Error("expected an unknown certificate to be refused, got ", string(res))
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	f.Close()
+
+	env.Client, err = NewClient(ClientConfig{CABundle: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := env.grab12306L(context.Background(), make(chan []byte, 1), ts.URL); string(res) != "ok" {
+		t.Error("expected the bundled CA to be trusted, got ", string(res))
+	}
+}
+
+func TestSessionWarmsUpAndRotates(t *testing.T) {
+	var refuse int32
+	var agents []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/otn/leftTicket/init" {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "abc", Path: "/otn"})
+			return
+		}
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+		if c, err := r.Cookie("JSESSIONID"); err != nil || c.Value != "abc" || atomic.LoadInt32(&refuse) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	profiles := []HeaderProfile{{UserAgent: "first"}, {UserAgent: "second"}}
+	env := &AppEnv{Session: NewSession(profiles, "/otn/leftTicket/init", 0)}
+	if res := env.grab12306L(context.Background(), make(chan []byte, 1), ts.URL+"/otn/leftTicket/query"); string(res) != "ok" {
+		t.Error("expected the warm-up cookie to be sent, got ", string(res))
+	}
+
+	atomic.StoreInt32(&refuse, 1)
+	env.grab12306L(context.Background(), make(chan []byte, 1), ts.URL+"/otn/leftTicket/query")
+	atomic.StoreInt32(&refuse, 0)
+	if res := env.grab12306L(context.Background(), make(chan []byte, 1), ts.URL+"/otn/leftTicket/query"); string(res) != "ok" {
+		t.Error("expected the new session to warm up again, got ", string(res))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents) != 3 || agents[0] != "first" || agents[1] != "first" || agents[2] != "second" {
+		t.Error("expected the profile to rotate after the refusal, got ", agents)
+	}
+}
+
+func TestSessionKeepsRedirectCookies(t *testing.T) {
+	var warmups int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/otn/leftTicket/init":
+			// the first warm-up fails, the next one sets its cookie on a redirect
+			if atomic.AddInt32(&warmups, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "abc", Path: "/otn"})
+			http.Redirect(w, r, "/otn/index/init", http.StatusFound)
+		case "/otn/index/init":
+			http.SetCookie(w, &http.Cookie{Name: "route", Value: "r1", Path: "/"})
+		default:
+			c1, err1 := r.Cookie("JSESSIONID")
+			c2, err2 := r.Cookie("route")
+			if err1 != nil || err2 != nil || c1.Value != "abc" || c2.Value != "r1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer ts.Close()
+
+	s := NewSession(nil, "leftTicket/init", 0)
+	// try the failed warm-up again right away
+	s.retryMin = 0
+	get := func() int {
+		resp, err := s.Get(context.Background(), http.DefaultClient, ts.URL+"/otn/", ts.URL+"/otn/leftTicket/query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusForbidden {
+		t.Error("expected no cookie after the failed warm-up, got ", code)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Error("expected the cookies set on the redirect to be sent, got ", code)
+	}
+	if n := atomic.LoadInt32(&warmups); n != 2 {
+		t.Error("expected the failed warm-up to be tried again, got ", n, " warm-ups")
+	}
+}
+
+func TestSessionBacksOffMissingWarmUp(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/mirror/otn/leftTicket/init" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":true}`))
+	}))
+	defer ts.Close()
+
+	env := &AppEnv{
+		Upstreams: []Upstream{NewRail12306(ts.URL + "/mirror/otn/")},
+		Session:   NewSession(nil, "leftTicket/init", 0),
+	}
+	for i := 0; i < 3; i++ {
+		if res := env.grab12306L(context.Background(), make(chan []byte, 1), env.ticketsURL("2099-02-10", "BJP", "SHH", "ADULT")); string(res) != `{"status":true}` {
+			t.Error("expected the tickets, got ", string(res))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	warmups := 0
+	for _, p := range paths {
+		if p == "/mirror/otn/leftTicket/init" {
+			warmups++
+		}
+	}
+	if warmups != 1 || len(paths) != 4 {
+		t.Error("expected one warm-up below the base url, then none for a while, got ", paths)
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	u := NewRail12306("https://kyfw.12306.cn/otn/")
+	tickets := u.TicketsURL(queryEntryDefault, "2099-02-10", "BJP", "SHH", "ADULT")
+	if k := routeKey(tickets); k != "BJP|SHH|2099-02-10" {
+		t.Error("unexpected route key ", k)
+	}
+	price := u.TicketPriceURL(priceEntryDefault, "240000G1010I", "01", "11", "OM9", "2099-02-10")
+	if k := routeKey(price); k != "240000G1010I|01|11|OM9|2099-02-10" {
+		t.Error("unexpected price key ", k)
+	}
+}
+
+func TestWarmRouteDates(t *testing.T) {
+	now := time.Date(2099, 2, 10, 15, 0, 0, 0, time.Local)
+	cases := []struct {
+		route WarmRoute
+		first string
+		n     int
+	}{
+		{WarmRoute{}, "2099-02-10", 1},
+		{WarmRoute{Days: 3}, "2099-02-10", 3},
+		{WarmRoute{StartDate: "2099-02-12", EndDate: "2099-02-15"}, "2099-02-12", 4},
+		// the end date wins over days
+		{WarmRoute{StartDate: "2099-02-12", EndDate: "2099-02-12", Days: 5}, "2099-02-12", 1},
+		{WarmRoute{StartDate: "2099-02-12", EndDate: "2099-02-01"}, "2099-02-12", 1},
+		{WarmRoute{Days: 100}, "2099-02-10", maxWarmDays},
+		{WarmRoute{EndDate: "2099-12-31"}, "2099-02-10", maxWarmDays},
+	}
+	for _, c := range cases {
+		dates, err := c.route.dates(now)
+		if err != nil || len(dates) != c.n || dates[0] != c.first {
+			t.Error("unexpected dates for ", c.route, ": ", dates, err)
+		}
+	}
+	if dates, _ := (&WarmRoute{Days: 3}).dates(now); dates[2] != "2099-02-12" {
+		t.Error("expected consecutive dates, got ", dates)
+	}
+
+	if _, err := (&WarmRoute{StartDate: "2099/02/12"}).dates(now); err == nil {
+		t.Error("expected an invalid start date to be refused")
+	}
+	if _, err := (&WarmRoute{EndDate: "tomorrow"}).dates(now); err == nil {
+		t.Error("expected an invalid end date to be refused")
+	}
+}
+
+func TestWarmerSchedule(t *testing.T) {
+	wm := NewWarmer(&AppEnv{}, 0)
+	plan := WarmPlan{Routes: []WarmRoute{
+		{From: "BJP", To: "SHH", StartDate: "2099-02-10", Days: 2},
+		{From: "SHH", To: "BJP", PurposeCodes: "0X00", StartDate: "2099-02-10", EndDate: "2099-02-10"},
+	}}
+	if n, err := wm.Schedule(&plan); n != 3 || err != nil {
+		t.Fatal("expected 3 fetches to be scheduled, got ", n, err)
+	}
+	if st := wm.Status(); st.Queued != 3 || st.Pending != 3 {
+		t.Error("unexpected warm status ", st)
+	}
+	expected := []warmTask{
+		{from: "BJP", to: "SHH", date: "2099-02-10", codes: "ADULT"},
+		{from: "BJP", to: "SHH", date: "2099-02-11", codes: "ADULT"},
+		{from: "SHH", to: "BJP", date: "2099-02-10", codes: "0X00"},
+	}
+	for _, e := range expected {
+		if task := <-wm.tasks; task != e {
+			t.Error("expected ", e, ", got ", task)
+		}
+	}
+
+	// the tasks taken above are still in flight
+	if n, err := wm.Schedule(&plan); n != 0 || err != nil {
+		t.Error("expected the pending fetches to be skipped, got ", n, err)
+	}
+	if st := wm.Status(); st.Queued != 3 || st.Skipped != 3 {
+		t.Error("unexpected warm status ", st)
+	}
+
+	plan.Routes = append(plan.Routes, WarmRoute{From: "BJP"})
+	if _, err := wm.Schedule(&plan); err == nil {
+		t.Error("expected a route without to station to stop the schedule")
+	}
+}
+
+func TestUpdateCacheHandler(t *testing.T) {
+	env := &AppEnv{}
+	w := httptest.NewRecorder()
+	env.UpdateCacheHandler(w, httptest.NewRequest("POST", "/update_cache", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("expected 404 without a warmer, got ", w.Code)
+	}
+
+	env.Warmer = NewWarmer(env, 0)
+	w = httptest.NewRecorder()
+	env.UpdateCacheHandler(w, httptest.NewRequest("GET", "/update_cache", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("expected 405 for GET, got ", w.Code)
+	}
+
+	r := httptest.NewRequest("POST", "/update_cache", strings.NewReader(`{"routes":[{"from":"BJP","to":"SHH","days":3}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	env.UpdateCacheHandler(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"scheduled":3}` {
+		t.Error("expected the json plan to be scheduled, got ", w.Code, " ", w.Body.String())
+	}
+
+	r = httptest.NewRequest("POST", "/update_cache", strings.NewReader("from=BJP&to=SHH&start_date=2099-02-10&days=2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	env.UpdateCacheHandler(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"scheduled":2}` {
+		t.Error("expected the form route to be scheduled, got ", w.Code, " ", w.Body.String())
+	}
+
+	r = httptest.NewRequest("POST", "/update_cache", strings.NewReader("from=BJP&start_date=2099-02-10"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	env.UpdateCacheHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("expected 400 for a route without to station, got ", w.Code)
+	}
+	if st := env.Warmer.Status(); st.Queued != 5 {
+		t.Error("expected 5 queued fetches, got ", st.Queued)
+	}
+}
+
+func TestWarmStatusReportsFailures(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, fake := fake12306.NewTestServer()
+	defer ts.Close()
+	fake.SetMode(fake12306.HTMLError)
+
+	env := &AppEnv{Db: ticketdata.NewMemDB(), Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}}
+	env.Warmer = NewWarmer(env, 0)
+	go env.Warmer.Run()
+	if _, err := env.Warmer.Schedule(&WarmPlan{Routes: []WarmRoute{{From: "BJP", To: "SHH", StartDate: "2099-02-10", Days: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var st WarmStatus
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		env.WarmStatusHandler(w, httptest.NewRequest("GET", "/admin/warm", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Failed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected both fetches to fail, got ", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Done != 0 || len(st.Failures) != 2 {
+		t.Fatal("unexpected warm status ", st)
+	}
+	for i, date := range []string{"2099-02-10", "2099-02-11"} {
+		if f := st.Failures[i]; f.Route != "BJP-SHH" || f.Date != date || f.Error == "" {
+			t.Error("unexpected failure ", f)
+		}
+	}
+}
+
+func TestProberSwitchesEntry(t *testing.T) {
+	old := swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	defer swapAPI(old)
+
+	ts, fake := fake12306.NewTestServer()
+	defer ts.Close()
+	fake.SetQueryEntry("leftTicket/queryA")
+
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := &AppEnv{Upstreams: []Upstream{NewRail12306(ts.URL + "/otn/")}, APIFile: dir + "/api.json"}
+	env.Prober = NewProber(env, ProbeConfig{
+		QueryEntries: []string{queryEntryDefault, "leftTicket/queryX", "leftTicket/queryA"},
+		PriceEntries: []string{priceEntryDefault},
+		From:         "BJP",
+		To:           "SHH",
+		DaysAhead:    1,
+		TrainNo:      "240000G1010I",
+		SeatTypes:    "OM9",
+	})
+	env.Prober.RunOnce()
+
+	if api := currentAPI(); api.queryEntry != "leftTicket/queryA" || api.priceEntry != priceEntryDefault {
+		t.Error("expected the query entry to switch to the working candidate, got ", api)
+	}
+
+	w := httptest.NewRecorder()
+	env.ProbeStatusHandler(w, httptest.NewRequest("GET", "/admin/probe", nil))
+	var st probeStatus
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Ticket != "leftTicket/queryA" || st.Price != priceEntryDefault || len(st.Results) != 4 {
+		t.Fatal("unexpected probe status ", w.Body.String())
+	}
+	for _, r := range st.Results {
+		if ok := r.Entry == "leftTicket/queryA" || r.Kind == "price"; r.OK != ok {
+			t.Error("unexpected probe result ", r)
+		}
+	}
+
+	swapAPI(&api12306{queryEntryDefault, priceEntryDefault})
+	if err = LoadAPI(env.APIFile); err != nil || currentAPI().queryEntry != "leftTicket/queryA" {
+		t.Error("expected the switch to be saved, got ", currentAPI(), err)
+	}
+}
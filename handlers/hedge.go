@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/tjgao/CachedTickets/ws"
+	"sync/atomic"
+	"time"
+)
+
+// HedgePolicy sends a second copy of a slow task to another slave. The task is hedged once the first slave
+// took longer than the Percentile of its recent task times, the first valid answer wins and the other task is dropped.
+type HedgePolicy struct {
+	// 0 turns hedging off
+	Percentile float64
+	// never hedge sooner than this, it also covers slaves that have not done any task yet
+	MinDelay time.Duration
+}
+
+type hedgeAnswer struct {
+	slave *ws.Slave
+	res   []byte
+	ok    bool
+}
+
+// hedgedTask has first fetch url, and another slave as well if first is slow. The hedging slave is added to tried.
+// Both give up once parent is done.
+func (env *AppEnv) hedgedTask(parent context.Context, first *ws.Slave, tried *[]*ws.Slave, key, url string, validate func([]byte) error) ([]byte, bool) {
+	delay := first.Latency(env.Hedge.Percentile)
+	if delay < env.Hedge.MinDelay {
+		delay = env.Hedge.MinDelay
+	}
+
+	// cancels the task still running once we have an answer
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	answers := make(chan hedgeAnswer, 2)
+	run := func(s *ws.Slave) {
+		res, ok := env.doTask(ctx, s, url, validate)
+		answers <- hedgeAnswer{s, res, ok}
+	}
+	go run(first)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last []byte
+	for pending > 0 {
+		select {
+		case a := <-answers:
+			pending--
+			if a.ok {
+				if a.slave != first {
+					log.Info("hedged slave ", a.slave.Addr(), " answered before ", first.Addr(), ": ", url)
+				}
+				return a.res, true
+			}
+			last = a.res
+		case <-timer.C:
+			second := env.Ctx.GetOtherSlave(key, *tried)
+			if second == nil {
+				continue
+			}
+			*tried = append(*tried, second)
+			atomic.AddInt64(&env.stats.Hedged, 1)
+			log.Debug("slave ", first.Addr(), " is slower than ", delay, ", hedging with ", second.Addr(), ": ", url)
+			go run(second)
+			pending++
+		}
+	}
+	return last, false
+}
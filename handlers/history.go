@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type snapshotJSON struct {
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type historyJSON struct {
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	Date      string         `json:"date"`
+	Snapshots []snapshotJSON `json:"snapshots"`
+}
+
+// HistoryHandler serves the availability timeline of a route: /history?from=&to=&date=
+func (env *AppEnv) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	from := getQueryParam(r, "from")
+	to := getQueryParam(r, "to")
+	date := getQueryParam(r, "date")
+
+	w.Header().Set("Content-Type", "application/json")
+	if env.History == nil {
+		http.Error(w, `{"error":"history is not enabled"}`, http.StatusNotFound)
+		return
+	}
+	if len(from)*len(to)*len(date) == 0 {
+		http.Error(w, `{"error":"no enough params"}`, http.StatusBadRequest)
+		return
+	}
+
+	snapshots, err := env.History.Timeline(from, to, date)
+	if err != nil {
+		log.Error("failed to get ticket snapshots: ", err)
+		http.Error(w, `{"error":"failed to get history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	h := historyJSON{From: from, To: to, Date: date, Snapshots: make([]snapshotJSON, 0, len(snapshots))}
+	for _, s := range snapshots {
+		h.Snapshots = append(h.Snapshots, snapshotJSON{Time: s.CaptureTime.Unix(), Data: json.RawMessage(s.Content)})
+	}
+	bs, err := json.Marshal(&h)
+	if err != nil {
+		log.Error("failed to marshal a json object, err: ", err)
+		http.Error(w, `{"error":"failed to get history"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
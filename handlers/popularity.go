@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	popularQuery = "query"
+	popularPrice = "price"
+
+	// entries whose score decayed under this are forgotten
+	minPopularScore = 0.05
+)
+
+// PopularEntry is a left ticket query or a price query along with its decaying hit count.
+// It keeps every parameter needed to fetch it again.
+type PopularEntry struct {
+	Kind      string    `json:"kind"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Date      string    `json:"date"`
+	Codes     string    `json:"purpose_codes,omitempty"`
+	TrainNo   string    `json:"train_no,omitempty"`
+	SeatTypes string    `json:"seat_types,omitempty"`
+	Score     float64   `json:"score"`
+	Updated   time.Time `json:"updated"`
+
+	// rank orders entries by decayed score at any time, index is the position in the eviction heap
+	rank  float64
+	index int
+}
+
+func (e *PopularEntry) key() string {
+	if e.Kind == popularPrice {
+		return e.Kind + "|" + e.TrainNo + "|" + e.From + "|" + e.To + "|" + e.SeatTypes + "|" + e.Date
+	}
+	return e.Kind + "|" + e.From + "|" + e.To + "|" + e.Date + "|" + e.Codes
+}
+
+// coldHeap is a min-heap of entries on rank, the coldest entry on top
+type coldHeap []*PopularEntry
+
+func (h coldHeap) Len() int           { return len(h) }
+func (h coldHeap) Less(i, j int) bool { return h[i].rank < h[j].rank }
+func (h coldHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *coldHeap) Push(x interface{}) {
+	e := x.(*PopularEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *coldHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Popularity counts how often routes and prices are asked for. Counts halve every half life,
+// so the top entries are the ones hot right now rather than the ones hot last week.
+// At most maxEntries are kept, a new entry takes the place of the coldest one.
+type Popularity struct {
+	halfLife   time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*PopularEntry
+	cold    coldHeap
+}
+
+// NewPopularity needs a positive halfLife. A maxEntries of 0 or less keeps every entry.
+func NewPopularity(halfLife time.Duration, maxEntries int) (*Popularity, error) {
+	if halfLife <= 0 {
+		return nil, errors.New("popularity half life must be positive")
+	}
+	return &Popularity{
+		halfLife:   halfLife,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*PopularEntry),
+	}, nil
+}
+
+// rank is log2 of the score decayed to the zero time. Every score decays at the same pace,
+// so ranks order the entries the same way their decayed scores do, now or later.
+func (p *Popularity) rank(e *PopularEntry) float64 {
+	return math.Log2(e.Score) + float64(e.Updated.UnixNano())/float64(p.halfLife)
+}
+
+func (p *Popularity) decayed(e *PopularEntry, now time.Time) float64 {
+	return e.Score * math.Pow(0.5, float64(now.Sub(e.Updated))/float64(p.halfLife))
+}
+
+func (p *Popularity) hit(e PopularEntry) {
+	now := time.Now()
+	k := e.key()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.entries[k]; ok {
+		old.Score = p.decayed(old, now) + 1
+		old.Updated = now
+		old.rank = p.rank(old)
+		heap.Fix(&p.cold, old.index)
+		return
+	}
+	p.evict(1)
+	e.Score = 1
+	e.Updated = now
+	p.add(k, &e)
+}
+
+// add and remove keep the map and the heap in step, they must be called with p.mu held
+func (p *Popularity) add(k string, e *PopularEntry) {
+	e.rank = p.rank(e)
+	p.entries[k] = e
+	heap.Push(&p.cold, e)
+}
+
+func (p *Popularity) remove(k string, e *PopularEntry) {
+	delete(p.entries, k)
+	heap.Remove(&p.cold, e.index)
+}
+
+// evict forgets the coldest entries until n more fit, it must be called with p.mu held
+func (p *Popularity) evict(n int) {
+	if p.maxEntries <= 0 {
+		return
+	}
+	for len(p.cold) > 0 && len(p.cold)+n > p.maxEntries {
+		e := heap.Pop(&p.cold).(*PopularEntry)
+		delete(p.entries, e.key())
+	}
+}
+
+func (p *Popularity) recordQuery(from, to, date, codes string) {
+	p.hit(PopularEntry{Kind: popularQuery, From: from, To: to, Date: date, Codes: codes})
+}
+
+func (p *Popularity) recordPrice(trainNo, from, to, seatTypes, date string) {
+	p.hit(PopularEntry{Kind: popularPrice, TrainNo: trainNo, From: from, To: to, SeatTypes: seatTypes, Date: date})
+}
+
+// Top returns the n entries of kind with the highest current score, any kind if kind is empty.
+func (p *Popularity) Top(n int, kind string) []PopularEntry {
+	now := time.Now()
+
+	p.mu.Lock()
+	top := make([]PopularEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		if kind != "" && e.Kind != kind {
+			continue
+		}
+		c := *e
+		c.Score = p.decayed(e, now)
+		c.Updated = now
+		top = append(top, c)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool { return top[i].Score > top[j].Score })
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// prune forgets the entries that cooled down and the queries for travel dates already passed.
+func (p *Popularity) prune() {
+	now := time.Now()
+	today := now.Format(dateLayout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, e := range p.entries {
+		if p.decayed(e, now) < minPopularScore || e.Date < today {
+			p.remove(k, e)
+		}
+	}
+}
+
+// Save writes the counters to path as json.
+func (p *Popularity) Save(path string) error {
+	p.mu.Lock()
+	entries := make([]*PopularEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	b, err := json.Marshal(entries)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads the counters saved at path, a missing file is not an error.
+func (p *Popularity) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*PopularEntry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range entries {
+		k := e.key()
+		if old, ok := p.entries[k]; ok {
+			p.remove(k, old)
+		}
+		if e.Score > 0 {
+			p.add(k, e)
+		}
+	}
+	p.evict(0)
+	return nil
+}
+
+// Persist prunes and saves the counters to path on every interval, it never returns.
+func (p *Popularity) Persist(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		p.prune()
+		if path == "" {
+			continue
+		}
+		if err := p.Save(path); err != nil {
+			log.Error("failed to save route popularity: ", err)
+		}
+	}
+}
+
+// PopularHandler lists the hottest queries: /admin/popular?n=20&kind=query|price
+func (env *AppEnv) PopularHandler(w http.ResponseWriter, r *http.Request) {
+	if env.Popularity == nil {
+		http.Error(w, "popularity tracking is not enabled", http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	n, err := strconv.Atoi(getQueryParam(r, "n"))
+	if err != nil || n <= 0 {
+		n = 20
+	}
+	writeJSON(w, env.Popularity.Top(n, getQueryParam(r, "kind")))
+}
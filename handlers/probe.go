@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProbeConfig tells the prober which entries to try and with what.
+// The price entries are only probed when TrainNo is set, its stations and seat types must match a real train.
+type ProbeConfig struct {
+	Interval     time.Duration
+	QueryEntries []string
+	PriceEntries []string
+
+	// the test route, queried DaysAhead days from now
+	From      string
+	To        string
+	DaysAhead int
+
+	TrainNo       string
+	FromStationNo string
+	ToStationNo   string
+	SeatTypes     string
+}
+
+type probeResult struct {
+	Kind    string    `json:"kind"`
+	Entry   string    `json:"entry"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Latency int64     `json:"latency_ms"`
+	Time    time.Time `json:"time"`
+}
+
+type probeStatus struct {
+	LastRun time.Time     `json:"last_run"`
+	Ticket  string        `json:"ticket"`
+	Price   string        `json:"price"`
+	Results []probeResult `json:"results"`
+}
+
+// Prober periodically tries candidate 12306 entries against a test route. When the entry in use fails
+// and a candidate works, shared_api is switched to the first working candidate.
+type Prober struct {
+	env *AppEnv
+	cfg ProbeConfig
+
+	mu     sync.Mutex
+	status probeStatus
+}
+
+func NewProber(env *AppEnv, cfg ProbeConfig) *Prober {
+	return &Prober{env: env, cfg: cfg}
+}
+
+func (p *Prober) probe(kind, entry, url string, verify func(string) error) probeResult {
+	start := time.Now()
+	res := string(p.env.fetch(make(chan []byte, 1), url, nil))
+	err := verify(res)
+
+	r := probeResult{Kind: kind, Entry: entry, OK: err == nil, Latency: int64(time.Since(start) / time.Millisecond), Time: start}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// pick returns current if it works, or else the first working candidate; empty if none works
+func pick(results []probeResult, current string) string {
+	first := ""
+	for _, r := range results {
+		if !r.OK {
+			continue
+		}
+		if r.Entry == current {
+			return current
+		}
+		if first == "" {
+			first = r.Entry
+		}
+	}
+	return first
+}
+
+// RunOnce probes every candidate and switches the entries in use if needed.
+func (p *Prober) RunOnce() {
+	date := time.Now().AddDate(0, 0, p.cfg.DaysAhead).Format(dateLayout)
+	var queries, prices []probeResult
+	// entries are a matter of 12306 itself, the primary upstream tells
+	u := p.env.primary()
+
+	for _, entry := range p.cfg.QueryEntries {
+		queries = append(queries, p.probe("query", entry, u.TicketsURL(entry, date, p.cfg.From, p.cfg.To, "ADULT"), func(res string) error {
+			_, err := verifyTickets(&res)
+			return err
+		}))
+	}
+	if p.cfg.TrainNo != "" {
+		for _, entry := range p.cfg.PriceEntries {
+			url := u.TicketPriceURL(entry, p.cfg.TrainNo, p.cfg.FromStationNo, p.cfg.ToStationNo, p.cfg.SeatTypes, date)
+			prices = append(prices, p.probe("price", entry, url, func(res string) error {
+				_, err := verifyTicketPrice(&res)
+				return err
+			}))
+		}
+	}
+
+	if len(queries) > 0 && pick(queries, "") == "" {
+		log.Warn("none of the probed ticket query entries works")
+	}
+	if len(prices) > 0 && pick(prices, "") == "" {
+		log.Warn("none of the probed ticket price entries works")
+	}
+	var next api12306
+	_, changed := p.env.updateAPI(func(current api12306) api12306 {
+		next = current
+		if e := pick(queries, current.queryEntry); e != "" {
+			next.queryEntry = e
+		}
+		if e := pick(prices, current.priceEntry); e != "" {
+			next.priceEntry = e
+		}
+		return next
+	})
+	if changed {
+		log.Warn("probing found working 12306 entries: ticket ", next.queryEntry, ", price ", next.priceEntry)
+	}
+
+	p.mu.Lock()
+	p.status = probeStatus{
+		LastRun: time.Now(),
+		Ticket:  next.queryEntry,
+		Price:   next.priceEntry,
+		Results: append(queries, prices...),
+	}
+	p.mu.Unlock()
+}
+
+// Run probes on every interval, it never returns.
+func (p *Prober) Run() {
+	for {
+		p.RunOnce()
+		time.Sleep(p.cfg.Interval)
+	}
+}
+
+// ProbeStatusHandler shows the result of the last probing.
+func (env *AppEnv) ProbeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if env.Prober == nil {
+		http.Error(w, "probing is not enabled", http.StatusNotFound)
+		return
+	}
+	env.Prober.mu.Lock()
+	status := env.Prober.status
+	env.Prober.mu.Unlock()
+	writeJSON(w, &status)
+}
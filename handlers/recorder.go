@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one upstream fetch as saved by the Recorder.
+// Source is "master" or the address of the slave that did the fetch, Status is the http status
+// for master fetches and the task result code for slave ones.
+type Exchange struct {
+	URL      string    `json:"url"`
+	Source   string    `json:"source"`
+	Start    time.Time `json:"start"`
+	Duration int64     `json:"duration_ms"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Body     string    `json:"body"`
+}
+
+// Recorder writes every upstream exchange to its own json file in a fixtures directory.
+// The files are named after the time they were recorded, so sorting them by name gives the recording order.
+type Recorder struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int64
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir}, nil
+}
+
+func (rec *Recorder) Record(e *Exchange) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	rec.seq++
+	name := fmt.Sprintf("%s-%06d.json", e.Start.UTC().Format("20060102T150405.000000000"), rec.seq)
+	rec.mu.Unlock()
+	return ioutil.WriteFile(filepath.Join(rec.dir, name), b, 0644)
+}
+
+// Replayer answers fetches from the exchanges a Recorder saved. Exchanges are matched on the path and query
+// of the url, so recordings made against one upstream can be replayed whatever the upstream base is.
+// Repeated fetches of a url get its recordings in the order they were made, the last one over and over
+// once they run out.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+	served    map[string]int
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	rp := &Replayer{
+		exchanges: make(map[string][]*Exchange),
+		served:    make(map[string]int),
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var e Exchange
+		if err = json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		k := replayKey(e.URL)
+		rp.exchanges[k] = append(rp.exchanges[k], &e)
+	}
+	log.Info("loaded ", len(names), " recorded exchanges from ", dir)
+	return rp, nil
+}
+
+func replayKey(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return strings.TrimPrefix(u.RequestURI(), "/")
+}
+
+// Replay returns the recorded body for url, nil if url was never recorded or the recorded fetch failed.
+func (rp *Replayer) Replay(url string) []byte {
+	k := replayKey(url)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	recorded := rp.exchanges[k]
+	if len(recorded) == 0 {
+		log.Warn("no recorded exchange for ", url)
+		return nil
+	}
+	i := rp.served[k]
+	if i >= len(recorded) {
+		i = len(recorded) - 1
+	}
+	rp.served[k] = i + 1
+
+	e := recorded[i]
+	if e.Error != "" {
+		return nil
+	}
+	return []byte(e.Body)
+}
+
+func (env *AppEnv) record(url, source string, start time.Time, status int, err error, body []byte) {
+	if env.Recorder == nil {
+		return
+	}
+	e := Exchange{
+		URL:      url,
+		Source:   source,
+		Start:    start,
+		Duration: int64(time.Since(start) / time.Millisecond),
+		Status:   status,
+		Body:     string(body),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err = env.Recorder.Record(&e); err != nil {
+		log.Error("failed to record the exchange with ", url, ": ", err)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type apiJSON struct {
+	Ticket string `json:"ticket"`
+	Price  string `json:"price"`
+}
+
+// validEntry rejects anything but a path below leftTicket/, 12306 should never tell us to go elsewhere
+func validEntry(entry string) bool {
+	return strings.HasPrefix(entry, "leftTicket/") && !strings.ContainsAny(entry, "?#:&= ")
+}
+
+// isEntryChange tells whether res is the c_url reply 12306 sends when the ticket query entry moved,
+// pointing at an entry we would follow. Such a reply is final: asking again, elsewhere, gets the same one
+// until the caller follows it.
+func isEntryChange(res []byte) bool {
+	var msg urlChangeMsg
+	return json.Unmarshal(res, &msg) == nil && !msg.Status && validEntry(msg.URL)
+}
+
+// followEntryChange looks for the c_url 12306 replies with when the ticket query entry moved.
+// If there is one, the query entry is switched to it and true is returned so the caller can ask again.
+func (env *AppEnv) followEntryChange(res string) bool {
+	var msg urlChangeMsg
+	if err := json.Unmarshal([]byte(res), &msg); err != nil || msg.Status || msg.URL == "" {
+		return false
+	}
+	if !validEntry(msg.URL) {
+		log.Warn("ignored suspicious query entry change to ", msg.URL)
+		return false
+	}
+
+	// someone else may have followed it already
+	if old, ok := env.updateAPI(func(a api12306) api12306 { return api12306{msg.URL, a.priceEntry} }); ok {
+		atomic.AddInt64(&env.stats.EntryChanges, 1)
+		log.Warn("12306 moved the ticket query entry from ", old.queryEntry, " to ", msg.URL)
+	}
+	return true
+}
+
+// fetchTicketsFollowing is fetchTickets for background fetches: if 12306 moved the query entry,
+// the entry is switched and the tickets are asked again at the new one.
+func (env *AppEnv) fetchTicketsFollowing(date, from, to, codes string) string {
+	res := string(env.fetchTickets(make(chan []byte, 1), date, from, to, codes))
+	if _, err := verifyTickets(&res); err != nil && env.followEntryChange(res) {
+		log.Debug("request train info again -> " + env.ticketsURL(date, from, to, codes))
+		res = string(env.fetchTickets(make(chan []byte, 1), date, from, to, codes))
+	}
+	return res
+}
+
+// setAPI switches the 12306 entries in use and saves them to APIFile.
+func (env *AppEnv) setAPI(api *api12306) {
+	env.apiChanged(swapAPI(api), api)
+}
+
+// updateAPI switches the entries in use to what change makes of them, without losing a switch made meanwhile:
+// change is applied again to the new entries until none came in between. It returns the entries replaced,
+// and false if change left them as they were.
+func (env *AppEnv) updateAPI(change func(api12306) api12306) (*api12306, bool) {
+	for {
+		old := currentAPI()
+		next := change(*old)
+		if next == *old {
+			return old, false
+		}
+		if casAPI(old, &next) {
+			env.apiChanged(old, &next)
+			return old, true
+		}
+	}
+}
+
+func (env *AppEnv) apiChanged(old, api *api12306) {
+	log.Info("12306 entries changed: ticket ", old.queryEntry, " -> ", api.queryEntry, ", price ", old.priceEntry, " -> ", api.priceEntry)
+	if env.APIFile == "" {
+		return
+	}
+	if err := saveAPI(env.APIFile, api); err != nil {
+		log.Error("failed to save 12306 entries: ", err)
+	}
+}
+
+func saveAPI(path string, api *api12306) error {
+	b, err := json.Marshal(&apiJSON{api.queryEntry, api.priceEntry})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadAPI restores the 12306 entries saved at path, a missing file keeps the defaults.
+func LoadAPI(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var a apiJSON
+	if err = json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	if !validEntry(a.Ticket) || !validEntry(a.Price) {
+		log.Warn("ignored invalid 12306 entries in ", path)
+		return nil
+	}
+	swapAPI(&api12306{a.Ticket, a.Price})
+	log.Info("loaded 12306 entries: ticket ", a.Ticket, ", price ", a.Price)
+	return nil
+}
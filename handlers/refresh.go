@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+type refreshJob struct {
+	key string
+	run func()
+}
+
+// Refresher runs background refreshes of cache entries on a bounded pool of workers.
+// A key is never refreshed twice at the same time, and jobs are dropped when the queue is full.
+type Refresher struct {
+	jobs chan refreshJob
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func NewRefresher(workers, queue int) *Refresher {
+	r := &Refresher{
+		jobs:    make(chan refreshJob, queue),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+func (r *Refresher) work() {
+	for job := range r.jobs {
+		job.run()
+
+		r.mu.Lock()
+		delete(r.pending, job.key)
+		r.mu.Unlock()
+	}
+}
+
+// Submit queues fn under key. It returns false if key is already being refreshed or the queue is full.
+func (r *Refresher) Submit(key string, fn func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending[key] {
+		return false
+	}
+	select {
+	case r.jobs <- refreshJob{key, fn}:
+		r.pending[key] = true
+		return true
+	default:
+		log.Warn("refresh queue is full, dropped refresh of ", key)
+		return false
+	}
+}
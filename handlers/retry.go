@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/tjgao/CachedTickets/ws"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy decides how hard grab12306 tries a url before giving up.
+// Each retry goes to a slave not tried yet, then to master if it takes requests.
+type RetryPolicy struct {
+	// tries in total, the first one included, 0 or 1 never retries
+	Attempts int
+	// pause before the first retry, doubled before each further one
+	Backoff time.Duration
+}
+
+// doTask has slave fetch url, ok is false when the slave failed, timed out or answered something validate refuses.
+// A c_url reply is ok, the caller follows it rather than retrying.
+func (env *AppEnv) doTask(ctx context.Context, slave *ws.Slave, url string, validate func([]byte) error) ([]byte, bool) {
+	start := time.Now()
+	result, err := slave.DoTaskContext(ctx, url)
+	if err == context.Canceled {
+		log.Debug("dropped the task of slave ", slave.Addr(), ": ", url)
+		return nil, false
+	}
+	if err != nil {
+		env.record(url, slave.Addr(), start, 0, err, nil)
+		log.Warn("slave ", slave.Addr(), " failed to fetch ", url, ": ", err)
+		return nil, false
+	}
+	env.record(url, slave.Addr(), start, result.Code, nil, result.Result)
+	if result.Code != ws.RetrieveDataSuccessfully {
+		log.Warn("slave ", slave.Addr(), " failed to fetch ", url, ": ", result.Description)
+		return result.Result, false
+	}
+	if validate != nil && !isEntryChange(result.Result) {
+		if err = validate(result.Result); err != nil {
+			log.Warn("slave ", slave.Addr(), " got an invalid answer for ", url, ": ", err)
+			return result.Result, false
+		}
+	}
+	return result.Result, true
+}
+
+// attemptTimeout is how long attempt i of attempts may take: an even share of what is left before deadline,
+// and no more than the slave task timeout for slaves, so that a hanging slave leaves time for the retries
+func (env *AppEnv) attemptTimeout(deadline time.Time, i, attempts int, slave bool) time.Duration {
+	d := time.Until(deadline) / time.Duration(attempts-i)
+	if tt := env.Ctx.TaskTimeout(); slave && tt > 0 && tt < d {
+		d = tt
+	}
+	return d
+}
+
+// grabWithRetry fetches url through the slaves and master following env.Retry, giving up once ctx is done
+func (env *AppEnv) grabWithRetry(ctx context.Context, url string, validate func([]byte) error) []byte {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(env.timeout())
+	}
+	attempts := env.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := env.Retry.Backoff
+
+	key := routeKey(url)
+	var ret []byte
+	var tried []*ws.Slave
+	masterTried := false
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if time.Now().Add(backoff).After(deadline) {
+				log.Warn("no time left to retry ", url)
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ret
+			}
+			backoff *= 2
+			atomic.AddInt64(&env.stats.Retries, 1)
+		}
+
+		// a nil slave on the first attempt means master takes the request
+		var slave *ws.Slave
+		if i == 0 {
+			slave = env.Ctx.GetSlaveFor(key)
+		} else {
+			slave = env.Ctx.GetOtherSlave(key, tried)
+			if slave == nil && (masterTried || !env.Ctx.MasterWork()) {
+				break
+			}
+		}
+
+		actx, cancel := context.WithTimeout(ctx, env.attemptTimeout(deadline, i, attempts, slave != nil))
+		if slave == nil {
+			log.Debug("master takes the request: ", url)
+			masterTried = true
+			ret = env.grab12306L(actx, make(chan []byte, 1), url)
+			cancel()
+			if len(ret) > 0 && (validate == nil || validate(ret) == nil || isEntryChange(ret)) {
+				return ret
+			}
+			continue
+		}
+
+		tried = append(tried, slave)
+		var ok bool
+		if env.Hedge.Percentile > 0 {
+			ret, ok = env.hedgedTask(actx, slave, &tried, key, url, validate)
+		} else {
+			ret, ok = env.doTask(actx, slave, url, validate)
+		}
+		cancel()
+		if ok {
+			if i > 0 {
+				log.Info("slave ", slave.Addr(), " took over ", url, " after ", i, " failed attempts")
+			}
+			return ret
+		}
+	}
+	return ret
+}
+
+// routeKey tells which route or train price url asks 12306 for, so that slave selection can keep a route on one slave.
+// It is empty for other urls.
+func routeKey(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	if from := q.Get("leftTicketDTO.from_station"); from != "" {
+		return from + "|" + q.Get("leftTicketDTO.to_station") + "|" + q.Get("leftTicketDTO.train_date")
+	}
+	if trainNo := q.Get("train_no"); trainNo != "" {
+		return trainNo + "|" + q.Get("from_station_no") + "|" + q.Get("to_station_no") + "|" + q.Get("seat_types") + "|" + q.Get("train_date")
+	}
+	return ""
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HeaderProfile is the set of headers one browser sends.
+type HeaderProfile struct {
+	UserAgent      string `json:"user_agent"`
+	Referer        string `json:"referer"`
+	Accept         string `json:"accept"`
+	AcceptLanguage string `json:"accept_language"`
+}
+
+var defaultHeaderProfiles = []HeaderProfile{
+	{
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		Referer:        "https://kyfw.12306.cn/otn/leftTicket/init",
+		Accept:         "*/*",
+		AcceptLanguage: "zh-CN,zh;q=0.9,en;q=0.8",
+	},
+	{
+		UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+		Referer:        "https://kyfw.12306.cn/otn/leftTicket/init",
+		Accept:         "application/json, text/javascript, */*; q=0.01",
+		AcceptLanguage: "zh-CN,zh-Hans;q=0.9",
+	},
+	{
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0",
+		Referer:        "https://kyfw.12306.cn/otn/leftTicket/init",
+		Accept:         "*/*",
+		AcceptLanguage: "zh-CN,zh;q=0.8,zh-TW;q=0.7,en-US;q=0.3",
+	},
+}
+
+// LoadHeaderProfiles reads a json array of HeaderProfile from path.
+func LoadHeaderProfiles(path string) ([]HeaderProfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []HeaderProfile
+	if err = json.Unmarshal(b, &profiles); err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("no header profile in " + path)
+	}
+	return profiles, nil
+}
+
+// a warm-up page that fails is tried again after warmRetryMin, doubled on each further failure up to warmRetryMax,
+// so that upstreams without one (mirrors, recorders, fakes) do not get a useless request before every fetch
+const (
+	warmRetryMin = time.Minute
+	warmRetryMax = time.Hour
+)
+
+type warmBackoff struct {
+	next time.Time
+	wait time.Duration
+}
+
+// Session makes master fetches look like one browser visiting 12306: it keeps the cookies upstream hands out,
+// visits the warm-up page of an upstream before querying it, and sends the headers of its current profile.
+// After lifetime, or once upstream refuses a request, the session starts over with the next profile and no cookies.
+type Session struct {
+	profiles []HeaderProfile
+	warmPath string
+	lifetime time.Duration
+	retryMin time.Duration
+
+	mu      sync.Mutex
+	jar     *cookiejar.Jar
+	profile int
+	started time.Time
+	// both keyed on the warm-up url, failures outlive the session as they are a matter of the upstream
+	warmed map[string]bool
+	failed map[string]*warmBackoff
+}
+
+// NewSession uses the default browser profiles if profiles is empty. warmPath is resolved against the base url
+// of each upstream, an empty one skips the warm-up. A zero lifetime keeps a session until upstream refuses it.
+func NewSession(profiles []HeaderProfile, warmPath string, lifetime time.Duration) *Session {
+	if len(profiles) == 0 {
+		profiles = defaultHeaderProfiles
+	}
+	s := &Session{
+		profiles: profiles,
+		warmPath: warmPath,
+		lifetime: lifetime,
+		retryMin: warmRetryMin,
+		profile:  -1,
+		failed:   make(map[string]*warmBackoff),
+	}
+	s.renew()
+	return s
+}
+
+// renew must be called with s.mu held
+func (s *Session) renew() {
+	s.jar, _ = cookiejar.New(nil)
+	s.profile = (s.profile + 1) % len(s.profiles)
+	s.started = time.Now()
+	s.warmed = make(map[string]bool)
+}
+
+// Renew drops the cookies and moves on to the next profile.
+func (s *Session) Renew() {
+	s.mu.Lock()
+	s.renew()
+	s.mu.Unlock()
+}
+
+// current returns the jar and profile to use, and whether the warm-up page wu is worth a visit
+func (s *Session) current(wu string) (*cookiejar.Jar, HeaderProfile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lifetime > 0 && time.Since(s.started) > s.lifetime {
+		s.renew()
+	}
+	warm := wu != "" && !s.warmed[wu]
+	if f, ok := s.failed[wu]; ok && warm && time.Now().Before(f.next) {
+		warm = false
+	}
+	return s.jar, s.profiles[s.profile], warm
+}
+
+// warmedUp records that wu was visited in the session of jar, unless the session was renewed since
+func (s *Session) warmedUp(jar *cookiejar.Jar, wu string) {
+	s.mu.Lock()
+	if s.jar == jar {
+		s.warmed[wu] = true
+	}
+	delete(s.failed, wu)
+	s.mu.Unlock()
+}
+
+// warmUpFailed puts off the next visit of wu
+func (s *Session) warmUpFailed(wu string) {
+	s.mu.Lock()
+	f, ok := s.failed[wu]
+	if !ok {
+		f = &warmBackoff{wait: s.retryMin}
+		s.failed[wu] = f
+	} else if f.wait *= 2; f.wait > warmRetryMax {
+		f.wait = warmRetryMax
+	}
+	f.next = time.Now().Add(f.wait)
+	s.mu.Unlock()
+}
+
+// warmURL resolves the warm-up page against base, the base url of the upstream serving u.
+// Without a base, the page is resolved against the root of the host of u.
+func (s *Session) warmURL(base string, u *url.URL) *url.URL {
+	if s.warmPath == "" {
+		return nil
+	}
+	b := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	if base != "" {
+		if pb, err := url.Parse(base); err == nil {
+			b = pb
+		}
+	}
+	ref, err := url.Parse(s.warmPath)
+	if err != nil {
+		return nil
+	}
+	return b.ResolveReference(ref)
+}
+
+// send has the jar of the session keep the cookies of every response, those of redirects included
+func (s *Session) send(ctx context.Context, client *http.Client, jar *cookiejar.Jar, p *HeaderProfile, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", p.UserAgent)
+	req.Header.Set("Accept", p.Accept)
+	if p.Referer != "" {
+		req.Header.Set("Referer", p.Referer)
+	}
+	if p.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", p.AcceptLanguage)
+	}
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+
+	c := &http.Client{Transport: client.Transport, CheckRedirect: client.CheckRedirect, Timeout: client.Timeout, Jar: jar}
+	return c.Do(req)
+}
+
+// Get fetches rawurl within the session, visiting the warm-up page of its upstream first if needed.
+// base is the base url of that upstream, empty if rawurl belongs to none. Both requests give up once ctx is done.
+func (s *Session) Get(ctx context.Context, client *http.Client, base, rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	wu := s.warmURL(base, u)
+	key := ""
+	if wu != nil {
+		key = wu.String()
+	}
+	jar, p, warm := s.current(key)
+	if warm {
+		resp, err := s.send(ctx, client, jar, &p, wu)
+		if err != nil {
+			log.Warn("session warm-up failed: ", err)
+			s.warmUpFailed(key)
+		} else {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				log.Warn("session warm-up at ", wu, " failed with status ", resp.StatusCode, ", not trying again for a while")
+				s.warmUpFailed(key)
+			} else {
+				s.warmedUp(jar, key)
+				log.Debug("session warmed up at ", wu, ", got ", len(jar.Cookies(u)), " cookies")
+			}
+		}
+	}
+
+	resp, err := s.send(ctx, client, jar, &p, u)
+	if err == nil && resp.StatusCode >= 400 {
+		log.Info("upstream refused the session with status ", resp.StatusCode, ", starting a new one")
+		s.Renew()
+	}
+	return resp, err
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"github.com/tjgao/CachedTickets/ticketdata"
+	"net/http"
+	"sync/atomic"
+)
+
+// appStats are the counters shown on /admin/stats, updated atomically.
+type appStats struct {
+	UpstreamFetches int64 `json:"upstream_fetches"`
+	Coalesced       int64 `json:"coalesced"`
+	StaleServed     int64 `json:"stale_served"`
+	Refreshed       int64 `json:"refreshed"`
+	EntryChanges    int64 `json:"entry_changes"`
+	Retries         int64 `json:"retries"`
+	Hedged          int64 `json:"hedged"`
+}
+
+type statsJSON struct {
+	appStats
+	LRU *ticketdata.LRUStats `json:"lru,omitempty"`
+}
+
+func (s *appStats) snapshot() appStats {
+	return appStats{
+		UpstreamFetches: atomic.LoadInt64(&s.UpstreamFetches),
+		Coalesced:       atomic.LoadInt64(&s.Coalesced),
+		StaleServed:     atomic.LoadInt64(&s.StaleServed),
+		Refreshed:       atomic.LoadInt64(&s.Refreshed),
+		EntryChanges:    atomic.LoadInt64(&s.EntryChanges),
+		Retries:         atomic.LoadInt64(&s.Retries),
+		Hedged:          atomic.LoadInt64(&s.Hedged),
+	}
+}
+
+// StatsHandler shows the counters of the proxy.
+func (env *AppEnv) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	data := statsJSON{appStats: env.stats.snapshot()}
+	if lru, ok := env.Db.(*ticketdata.LRU); ok {
+		s := lru.Stats()
+		data.LRU = &s
+	}
+	writeJSON(w, &data)
+}
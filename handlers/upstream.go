@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+const defaultBaseURL = "https://kyfw.12306.cn/otn/"
+
+// Upstream is a source of left tickets and ticket prices: 12306 itself, a mirror, a recording proxy or a fake.
+// The entry is the path of the query or price api below the base url, see api12306.
+type Upstream interface {
+	Name() string
+	BaseURL() string
+	TicketsURL(entry, date, from, to, codes string) string
+	TicketPriceURL(entry, trainNo, from, to, seatTypes, date string) string
+	// ValidateTickets and ValidateTicketPrice tell whether a response is worth serving
+	ValidateTickets(body []byte) error
+	ValidateTicketPrice(body []byte) error
+}
+
+// Rail12306 is an Upstream speaking the 12306 api at a base url, the real one or anything mimicking it.
+type Rail12306 struct {
+	base string
+}
+
+// NewRail12306 returns the 12306 upstream at base, the official site if base is empty.
+func NewRail12306(base string) *Rail12306 {
+	if base == "" {
+		base = defaultBaseURL
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return &Rail12306{base}
+}
+
+func (u *Rail12306) Name() string {
+	return "12306@" + u.base
+}
+
+func (u *Rail12306) BaseURL() string {
+	return u.base
+}
+
+func (u *Rail12306) TicketsURL(entry, date, from, to, codes string) string {
+	return u.base + entry + "?leftTicketDTO.train_date=" +
+		date + "&leftTicketDTO.from_station=" + from + "&leftTicketDTO.to_station=" +
+		to + "&purpose_codes=" + codes
+}
+
+func (u *Rail12306) TicketPriceURL(entry, trainNo, from, to, seatTypes, date string) string {
+	return u.base + entry + "?train_no=" + trainNo +
+		"&from_station_no=" + from + "&to_station_no=" + to + "&seat_types=" + seatTypes +
+		"&train_date=" + date
+}
+
+func (u *Rail12306) ValidateTickets(body []byte) error {
+	res := string(body)
+	_, err := verifyTickets(&res)
+	return err
+}
+
+func (u *Rail12306) ValidateTicketPrice(body []byte) error {
+	res := string(body)
+	_, err := verifyTicketPrice(&res)
+	return err
+}
+
+var defaultUpstream Upstream = NewRail12306("")
+
+// primary is the first upstream, the one asked first and whose urls key the cache refreshes
+func (env *AppEnv) primary() Upstream {
+	if len(env.Upstreams) == 0 {
+		return defaultUpstream
+	}
+	return env.Upstreams[0]
+}
+
+func (env *AppEnv) upstreams() []Upstream {
+	if len(env.Upstreams) == 0 {
+		return []Upstream{defaultUpstream}
+	}
+	return env.Upstreams
+}
+
+// baseOf returns the base url of the upstream url belongs to, empty if none
+func (env *AppEnv) baseOf(url string) string {
+	for _, u := range env.upstreams() {
+		if strings.HasPrefix(url, u.BaseURL()) {
+			return u.BaseURL()
+		}
+	}
+	return ""
+}
+
+func (env *AppEnv) ticketsURL(date, from, to, codes string) string {
+	return env.primary().TicketsURL(currentAPI().queryEntry, date, from, to, codes)
+}
+
+func (env *AppEnv) ticketPriceURL(trainNo, from, to, seatTypes, date string) string {
+	return env.primary().TicketPriceURL(currentAPI().priceEntry, trainNo, from, to, seatTypes, date)
+}
+
+// fetchFailover asks the upstreams in order until one answers something valid, and sends that on ch.
+// If none does, the answer of the primary upstream is sent so the caller can look into it,
+// right away if it is a c_url reply.
+func (env *AppEnv) fetchFailover(ch chan []byte, urlOf func(Upstream) string, validate func(Upstream, []byte) error) []byte {
+	var first []byte
+	for i, u := range env.upstreams() {
+		url := urlOf(u)
+		res := env.fetch(make(chan []byte, 1), url, func(b []byte) error {
+			return validate(u, b)
+		})
+		err := validate(u, res)
+		if err == nil {
+			if i > 0 {
+				log.Info("upstream ", u.Name(), " took over: ", url)
+			}
+			ch <- res
+			return res
+		}
+		if i == 0 {
+			if isEntryChange(res) {
+				// the other upstreams would be asked at the same stale entry
+				ch <- res
+				return res
+			}
+			first = res
+		}
+		log.Debug("upstream ", u.Name(), " gave an invalid answer: ", err)
+	}
+	ch <- first
+	return first
+}
+
+func (env *AppEnv) fetchTickets(ch chan []byte, date, from, to, codes string) []byte {
+	entry := currentAPI().queryEntry
+	return env.fetchFailover(ch, func(u Upstream) string {
+		return u.TicketsURL(entry, date, from, to, codes)
+	}, func(u Upstream, b []byte) error {
+		return u.ValidateTickets(b)
+	})
+}
+
+func (env *AppEnv) fetchTicketPrice(ch chan []byte, trainNo, from, to, seatTypes, date string) []byte {
+	entry := currentAPI().priceEntry
+	return env.fetchFailover(ch, func(u Upstream) string {
+		return u.TicketPriceURL(entry, trainNo, from, to, seatTypes, date)
+	}, func(u Upstream, b []byte) error {
+		return u.ValidateTicketPrice(b)
+	})
+}
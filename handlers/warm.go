@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tjgao/CachedTickets/ticketdata"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	// 12306 does not sell tickets much further ahead
+	maxWarmDays       = 60
+	warmQueueSize     = 4096
+	warmFailuresShown = 20
+)
+
+// WarmRoute is a route whose left tickets are fetched for every travel date from StartDate on,
+// for Days days or until EndDate. An empty StartDate means today.
+type WarmRoute struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	PurposeCodes string `json:"purpose_codes"`
+	StartDate    string `json:"start_date"`
+	EndDate      string `json:"end_date"`
+	Days         int    `json:"days"`
+}
+
+// WarmPlan is what /update_cache accepts, and what the warm config file holds.
+// Interval only matters for the config file: the plan is run again on every interval.
+type WarmPlan struct {
+	Interval string      `json:"interval"`
+	Routes   []WarmRoute `json:"routes"`
+}
+
+type warmTask struct {
+	from, to, date, codes string
+
+	// set for ticket price fetches, from and to then hold station numbers
+	trainNo, seatTypes string
+}
+
+func (task *warmTask) label() string {
+	if task.trainNo != "" {
+		return task.trainNo + " " + task.from + "-" + task.to
+	}
+	return task.from + "-" + task.to
+}
+
+type warmFailure struct {
+	Route string    `json:"route"`
+	Date  string    `json:"date"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// WarmStatus is reported on /admin/warm.
+type WarmStatus struct {
+	Queued   int64         `json:"queued"`
+	Skipped  int64         `json:"skipped"`
+	Done     int64         `json:"done"`
+	Failed   int64         `json:"failed"`
+	Pending  int           `json:"pending"`
+	Current  string        `json:"current,omitempty"`
+	LastDone time.Time     `json:"last_done"`
+	Failures []warmFailure `json:"recent_failures"`
+}
+
+// Warmer fetches planned routes ahead of the clients, one at a time with a pause in between so
+// that upstream is not hammered. Fetches go through grab12306, so slaves take their share.
+type Warmer struct {
+	env   *AppEnv
+	delay time.Duration
+	tasks chan warmTask
+
+	mu     sync.Mutex
+	status WarmStatus
+	// tasks queued or in flight, a task is not queued twice
+	pending map[warmTask]bool
+}
+
+var (
+	errWarmPending   = errors.New("already queued")
+	errWarmQueueFull = errors.New("warm queue is full")
+)
+
+func NewWarmer(env *AppEnv, delay time.Duration) *Warmer {
+	return &Warmer{
+		env:     env,
+		delay:   delay,
+		tasks:   make(chan warmTask, warmQueueSize),
+		pending: make(map[warmTask]bool),
+	}
+}
+
+// LoadWarmPlan reads a json WarmPlan from path.
+func LoadWarmPlan(path string) (*WarmPlan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan WarmPlan
+	if err = json.Unmarshal(b, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func (route *WarmRoute) dates(now time.Time) ([]string, error) {
+	start := now
+	if route.StartDate != "" {
+		t, err := time.ParseInLocation(dateLayout, route.StartDate, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid start date %s", route.StartDate)
+		}
+		start = t
+	}
+	days := route.Days
+	if route.EndDate != "" {
+		end, err := time.ParseInLocation(dateLayout, route.EndDate, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid end date %s", route.EndDate)
+		}
+		days = int(end.Sub(start).Hours()/24) + 1
+	}
+	if days <= 0 {
+		days = 1
+	}
+	if days > maxWarmDays {
+		days = maxWarmDays
+	}
+
+	dates := make([]string, 0, days)
+	for i := 0; i < days; i++ {
+		dates = append(dates, start.AddDate(0, 0, i).Format(dateLayout))
+	}
+	return dates, nil
+}
+
+// Schedule queues every route and date of plan, it returns how many fetches were queued.
+// Routes and dates still queued or in flight from an earlier schedule are skipped.
+func (wm *Warmer) Schedule(plan *WarmPlan) (int, error) {
+	now := time.Now()
+	n := 0
+	for _, route := range plan.Routes {
+		if route.From == "" || route.To == "" {
+			return n, errors.New("route without from or to station")
+		}
+		codes := route.PurposeCodes
+		if codes == "" {
+			codes = "ADULT"
+		}
+		dates, err := route.dates(now)
+		if err != nil {
+			return n, err
+		}
+		for _, date := range dates {
+			switch wm.enqueue(warmTask{from: route.From, to: route.To, date: date, codes: codes}) {
+			case nil:
+				n++
+			case errWarmQueueFull:
+				return n, errWarmQueueFull
+			}
+		}
+	}
+	return n, nil
+}
+
+func (wm *Warmer) enqueue(task warmTask) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	if wm.pending[task] {
+		wm.status.Skipped++
+		return errWarmPending
+	}
+	select {
+	case wm.tasks <- task:
+		wm.pending[task] = true
+		wm.status.Queued++
+		return nil
+	default:
+		return errWarmQueueFull
+	}
+}
+
+// RunPlan schedules plan now and then on every interval, it never returns.
+func (wm *Warmer) RunPlan(plan *WarmPlan, interval time.Duration) {
+	for {
+		n, err := wm.Schedule(plan)
+		if err != nil {
+			log.Error("failed to schedule cache warming: ", err)
+		}
+		log.Info("scheduled ", n, " cache warming fetches")
+		time.Sleep(interval)
+	}
+}
+
+// Run works through the queued fetches, it never returns.
+func (wm *Warmer) Run() {
+	for task := range wm.tasks {
+		wm.mu.Lock()
+		wm.status.Current = task.label() + " " + task.date
+		wm.mu.Unlock()
+
+		err := wm.warm(task)
+
+		wm.mu.Lock()
+		delete(wm.pending, task)
+		wm.status.Current = ""
+		wm.status.LastDone = time.Now()
+		if err != nil {
+			wm.status.Failed++
+			wm.status.Failures = append(wm.status.Failures, warmFailure{task.label(), task.date, err.Error(), time.Now()})
+			if len(wm.status.Failures) > warmFailuresShown {
+				wm.status.Failures = wm.status.Failures[1:]
+			}
+		} else {
+			wm.status.Done++
+		}
+		wm.mu.Unlock()
+
+		if err != nil {
+			log.Warn("failed to warm ", task.label(), " ", task.date, ": ", err)
+		}
+		time.Sleep(wm.delay)
+	}
+}
+
+func (wm *Warmer) warm(task warmTask) error {
+	if task.trainNo != "" {
+		return wm.warmPrice(task)
+	}
+	res := wm.env.fetchTicketsFollowing(task.date, task.from, task.to, task.codes)
+	js, err := verifyTickets(&res)
+	if err != nil {
+		return err
+	}
+	t := ticketdata.TicketEntity{From: task.from, To: task.to, Date: task.date, UpdateTime: time.Now()}
+	return wm.env.saveTicketsToDB(&t, js)
+}
+
+func (wm *Warmer) warmPrice(task warmTask) error {
+	res := string(wm.env.fetchTicketPrice(make(chan []byte, 1), task.trainNo, task.from, task.to, task.seatTypes, task.date))
+	js, err := verifyTicketPrice(&res)
+	if err != nil {
+		return err
+	}
+	if emptyTicketPriceJSON(js) {
+		return errors.New("got an empty ticket price")
+	}
+	t := ticketdata.TicketPriceEntity{TrainNo: task.trainNo, FromStationNo: task.from, ToStationNo: task.to, SeatTypes: task.seatTypes, UpdateTime: time.Now()}
+	return wm.env.saveTicketPriceToDB(&t, js)
+}
+
+// WarmPopular refreshes the n hottest queries and prices that would go stale before the next check,
+// checking on every interval. Without a max age in the cache policy, they are refreshed on every interval.
+// It never returns.
+func (wm *Warmer) WarmPopular(pop *Popularity, n int, interval time.Duration) {
+	for range time.Tick(interval) {
+		queued := 0
+		for _, e := range pop.Top(n, "") {
+			if !wm.needsWarming(&e, interval) {
+				continue
+			}
+			task := warmTask{from: e.From, to: e.To, date: e.Date, codes: e.Codes, trainNo: e.TrainNo, seatTypes: e.SeatTypes}
+			err := wm.enqueue(task)
+			if err == errWarmQueueFull {
+				log.Warn("warm queue is full, skipped popular entries")
+				break
+			}
+			if err == nil {
+				queued++
+			}
+		}
+		if queued > 0 {
+			log.Info("scheduled ", queued, " popular entries for warming")
+		}
+	}
+}
+
+func (wm *Warmer) needsWarming(e *PopularEntry, interval time.Duration) bool {
+	var updated time.Time
+	var maxAge time.Duration
+	if e.Kind == popularPrice {
+		t := ticketdata.TicketPriceEntity{TrainNo: e.TrainNo, FromStationNo: e.From, ToStationNo: e.To, SeatTypes: e.SeatTypes}
+		if _, err := wm.env.Db.GetTicketPrice(&t); err != nil {
+			return true
+		}
+		updated, maxAge = t.UpdateTime, wm.env.Policy.PriceMaxAge
+	} else {
+		t := ticketdata.TicketEntity{From: e.From, To: e.To, Date: e.Date}
+		if _, err := wm.env.Db.GetLeftTickets(&t); err != nil || t.Date != e.Date {
+			return true
+		}
+		updated, maxAge = t.UpdateTime, wm.env.Policy.QueryMaxAge
+	}
+	if maxAge <= 0 {
+		maxAge = interval
+	}
+	return time.Since(updated)+interval >= maxAge
+}
+
+func (wm *Warmer) Status() WarmStatus {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	s := wm.status
+	s.Pending = len(wm.tasks)
+	s.Failures = append([]warmFailure{}, wm.status.Failures...)
+	return s
+}
+
+// UpdateCacheHandler schedules cache warming. It takes a json WarmPlan as the request body,
+// or a single route as form values: from, to, purpose_codes, start_date and days.
+func (env *AppEnv) UpdateCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if env.Warmer == nil {
+		http.Error(w, "cache warming is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var plan WarmPlan
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+			http.Error(w, "invalid warm plan: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		r.ParseForm()
+		days, _ := strconv.Atoi(getQueryParam(r, "days"))
+		plan.Routes = []WarmRoute{{
+			From:         getQueryParam(r, "from"),
+			To:           getQueryParam(r, "to"),
+			PurposeCodes: getQueryParam(r, "purpose_codes"),
+			StartDate:    getQueryParam(r, "start_date"),
+			Days:         days,
+		}}
+	}
+
+	n, err := env.Warmer.Schedule(&plan)
+	if err != nil {
+		log.Warn("failed to schedule cache warming: ", err)
+		http.Error(w, fmt.Sprintf("scheduled %d fetches, then failed: %v", n, err), http.StatusBadRequest)
+		return
+	}
+	log.Info("scheduled ", n, " cache warming fetches")
+	writeJSON(w, map[string]int{"scheduled": n})
+}
+
+// WarmStatusHandler reports the progress and recent failures of cache warming.
+func (env *AppEnv) WarmStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if env.Warmer == nil {
+		http.Error(w, "cache warming is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, env.Warmer.Status())
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/tjgao/CachedTickets/fake12306"
+	"github.com/tjgao/CachedTickets/fakeslave"
+	"github.com/tjgao/CachedTickets/handlers"
+	"github.com/tjgao/CachedTickets/ticketdata"
+	"github.com/tjgao/CachedTickets/ws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	harnessFrom = "BJP"
+	harnessTo   = "SHH"
+)
+
+// harness runs the router of main against an in-memory store and a fake 12306,
+// with slaves connected over /ws/register like real ones.
+type harness struct {
+	t *testing.T
+
+	db       *ticketdata.MemDB
+	env      *handlers.AppEnv
+	ctx      *ws.WSContext
+	fake     *fake12306.Server
+	upstream *httptest.Server
+	server   *httptest.Server
+	slaves   []*fakeslave.Slave
+}
+
+type harnessConfig struct {
+	slaves      int
+	masterWork  bool
+	taskTimeout time.Duration
+	timeout     time.Duration
+	retry       handlers.RetryPolicy
+	hedge       handlers.HedgePolicy
+	heartbeat   time.Duration
+	// random if nil
+	selector ws.Selector
+}
+
+func newHarness(t *testing.T, cfg harnessConfig) *harness {
+	if cfg.taskTimeout == 0 {
+		cfg.taskTimeout = 2 * time.Second
+	}
+	if cfg.timeout == 0 {
+		cfg.timeout = 5 * time.Second
+	}
+	h := &harness{t: t, db: ticketdata.NewMemDB()}
+	h.upstream, h.fake = fake12306.NewTestServer()
+
+	h.ctx = ws.NewWSContext(cfg.masterWork)
+	h.ctx.SetTaskTimeout(cfg.taskTimeout)
+	h.ctx.SetHeartbeat(cfg.heartbeat, 3)
+	if cfg.selector != nil {
+		h.ctx.SetSelector(cfg.selector)
+	}
+	go h.ctx.Run()
+
+	h.env = &handlers.AppEnv{
+		Db:        h.db,
+		Ctx:       h.ctx,
+		Upstreams: newUpstreams(h.upstream.URL + "/otn/"),
+		Timeout:   cfg.timeout,
+		Retry:     cfg.retry,
+		Hedge:     cfg.hedge,
+	}
+	h.server = httptest.NewServer(newRouter(h.env, h.ctx))
+
+	for i := 0; i < cfg.slaves; i++ {
+		s, err := fakeslave.Dial(h.server.URL)
+		if err != nil {
+			h.close()
+			t.Fatal("failed to connect a slave: ", err)
+		}
+		h.slaves = append(h.slaves, s)
+	}
+	h.waitSlaves(cfg.slaves)
+	return h
+}
+
+func (h *harness) close() {
+	for _, s := range h.slaves {
+		s.Close()
+	}
+	h.server.Close()
+	h.upstream.Close()
+}
+
+func (h *harness) slaveStatus() []ws.SlaveStatus {
+	resp, err := http.Get(h.server.URL + "/ws/status")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status []ws.SlaveStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		h.t.Fatal(err)
+	}
+	return status
+}
+
+func (h *harness) registeredSlaves() int {
+	return len(h.slaveStatus())
+}
+
+// waitSlaves waits until the master sees n slaves
+func (h *harness) waitSlaves(n int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for h.registeredSlaves() != n {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("expected %d registered slaves, got %d", n, h.registeredSlaves())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *harness) seed(date, content string) {
+	t := ticketdata.TicketEntity{From: harnessFrom, To: harnessTo, Date: date, Content: content}
+	if err := h.db.SaveLeftTickets(&t); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// query asks /query for the harness route on date, it returns the body and the X-Cache header
+func (h *harness) query(date string) (string, string) {
+	q := url.Values{
+		"leftTicketDTO.train_date":   {date},
+		"leftTicketDTO.from_station": {harnessFrom},
+		"leftTicketDTO.to_station":   {harnessTo},
+		"purpose_codes":              {"ADULT"},
+	}
+	resp, err := http.Get(h.server.URL + "/query?" + q.Encode())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return string(b), resp.Header.Get("X-Cache")
+}
+
+func travelDate(days int) string {
+	return time.Now().AddDate(0, 0, days).Format("2006-01-02")
+}
+
+func TestSlavesTakeRequests(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 2})
+	defer h.close()
+
+	for i := 0; i < 4; i++ {
+		if _, cache := h.query(travelDate(i + 1)); cache != "MISS" {
+			t.Error("expected live tickets, got ", cache)
+		}
+	}
+	if n := h.slaves[0].Tasks() + h.slaves[1].Tasks(); n != 4 {
+		t.Error("expected the slaves to take all 4 requests, they took ", n)
+	}
+}
+
+func TestSlaveTimeout(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 1, taskTimeout: 200 * time.Millisecond})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Hang)
+
+	date := travelDate(1)
+	h.seed(date, "cached")
+	start := time.Now()
+	body, cache := h.query(date)
+	if body != "cached" || cache != "STALE" {
+		t.Error("expected the cached tickets, got ", cache, " ", body)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected the slave timeout to cut the wait short, waited ", time.Since(start))
+	}
+	if h.fake.Requests() != 0 {
+		t.Error("expected no upstream request, got ", h.fake.Requests())
+	}
+}
+
+func TestSlaveDisconnectMidTask(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 1, taskTimeout: 5 * time.Second})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Disconnect)
+
+	date := travelDate(1)
+	h.seed(date, "cached")
+	start := time.Now()
+	body, cache := h.query(date)
+	if body != "cached" || cache != "STALE" {
+		t.Error("expected the cached tickets, got ", cache, " ", body)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected the disconnect to end the task, waited ", time.Since(start))
+	}
+	h.waitSlaves(0)
+
+	// with the slave gone, master takes the requests
+	if _, cache = h.query(date); cache != "MISS" {
+		t.Error("expected master to fetch live tickets, got ", cache)
+	}
+}
+
+func TestDBFallback(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 1})
+	defer h.close()
+	h.fake.SetMode(fake12306.HTMLError)
+
+	date := travelDate(1)
+	h.seed(date, "cached")
+	if body, cache := h.query(date); body != "cached" || cache != "STALE" {
+		t.Error("expected the cached tickets, got ", cache, " ", body)
+	}
+	if h.slaves[0].Tasks() != 1 {
+		t.Error("expected the slave to take the request, it took ", h.slaves[0].Tasks())
+	}
+}
+
+func TestAlternativeTicketFallback(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 1})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Fail)
+
+	h.seed(travelDate(2), "next day")
+	if body, cache := h.query(travelDate(1)); body != "next day" || cache != "ALTERNATIVE" {
+		t.Error("expected the tickets of another day, got ", cache, " ", body)
+	}
+}
+
+func TestMasterWork(t *testing.T) {
+	h := newHarness(t, harnessConfig{masterWork: true})
+	defer h.close()
+
+	date := travelDate(1)
+	body, cache := h.query(date)
+	if cache != "MISS" || h.fake.Requests() != 1 {
+		t.Error("expected master to fetch live tickets, got ", cache, " ", body)
+	}
+	saved := ticketdata.TicketEntity{From: harnessFrom, To: harnessTo, Date: date}
+	if _, err := h.db.GetLeftTickets(&saved); err != nil || saved.Date != date {
+		t.Error("expected the fetched tickets to be saved, got ", saved.Date, err)
+	}
+}
+
+func TestRetryOtherSlave(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 2, retry: handlers.RetryPolicy{Attempts: 2, Backoff: 10 * time.Millisecond}})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Fail)
+
+	for i := 0; i < 4; i++ {
+		if _, cache := h.query(travelDate(i + 1)); cache != "MISS" {
+			t.Error("expected the working slave to take over, got ", cache)
+		}
+	}
+	if h.slaves[1].Tasks() != 4 {
+		t.Error("expected the working slave to fetch every time, it fetched ", h.slaves[1].Tasks())
+	}
+}
+
+func TestRetryMaster(t *testing.T) {
+	retry := handlers.RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}
+
+	h := newHarness(t, harnessConfig{slaves: 1, retry: retry})
+	h.slaves[0].SetMode(fakeslave.Fail)
+	date := travelDate(1)
+	h.seed(date, "cached")
+	if _, cache := h.query(date); cache != "STALE" || h.fake.Requests() != 0 {
+		t.Error("expected master to stay out without -m, got ", cache, " and ", h.fake.Requests(), " upstream requests")
+	}
+	h.close()
+
+	h = newHarness(t, harnessConfig{slaves: 1, masterWork: true, retry: retry})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Fail)
+	for i := 0; i < 4; i++ {
+		if _, cache := h.query(travelDate(i + 1)); cache != "MISS" {
+			t.Error("expected master to take over, got ", cache)
+		}
+	}
+	if h.fake.Requests() != 4 {
+		t.Error("expected master to fetch every time, it fetched ", h.fake.Requests())
+	}
+}
+
+func TestHedgedRequest(t *testing.T) {
+	h := newHarness(t, harnessConfig{
+		slaves:      2,
+		taskTimeout: 3 * time.Second,
+		hedge:       handlers.HedgePolicy{Percentile: 95, MinDelay: 50 * time.Millisecond},
+	})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Hang)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, cache := h.query(travelDate(i + 1)); cache != "MISS" {
+			t.Error("expected the hedged slave to answer, got ", cache)
+		}
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected hedging to cut the wait short, waited ", time.Since(start))
+	}
+
+	// every task the hanging slave took is dropped once the other slave answered
+	deadline := time.Now().Add(time.Second)
+	for {
+		var cancelled uint
+		for _, s := range h.slaveStatus() {
+			cancelled += s.Cancelled
+		}
+		if int64(cancelled) == h.slaves[0].Tasks() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected ", h.slaves[0].Tasks(), " cancelled tasks, got ", cancelled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHeartbeatDropsDeadSlave(t *testing.T) {
+	h := newHarness(t, harnessConfig{slaves: 1, taskTimeout: 5 * time.Second, heartbeat: 50 * time.Millisecond})
+	defer h.close()
+
+	// an idle slave keeps answering pings
+	time.Sleep(300 * time.Millisecond)
+	if h.registeredSlaves() != 1 {
+		t.Fatal("expected the idle slave to stay registered")
+	}
+
+	h.slaves[0].SetMode(fakeslave.Unresponsive)
+	date := travelDate(1)
+	h.seed(date, "cached")
+	start := time.Now()
+	if body, cache := h.query(date); body != "cached" || cache != "STALE" {
+		t.Error("expected the cached tickets, got ", cache, " ", body)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected the missed heartbeats to end the task, waited ", time.Since(start))
+	}
+	h.waitSlaves(0)
+}
+
+func TestRetryWithinDeadline(t *testing.T) {
+	// the default timeouts: a hanging slave must not eat the whole request deadline
+	h := newHarness(t, harnessConfig{
+		slaves:      2,
+		taskTimeout: 10 * time.Second,
+		timeout:     10 * time.Second,
+		retry:       handlers.RetryPolicy{Attempts: 3, Backoff: 100 * time.Millisecond},
+		selector:    &ws.RoundRobin{},
+	})
+	defer h.close()
+	h.slaves[0].SetMode(fakeslave.Hang)
+
+	// taking the slaves in turn, the hanging one gets one of the first two requests
+	for i := 0; i < 2; i++ {
+		if _, cache := h.query(travelDate(i + 1)); cache != "MISS" {
+			t.Error("expected the working slave to take over, got ", cache)
+		}
+	}
+	if h.slaves[0].Tasks() == 0 {
+		t.Fatal("expected the hanging slave to take a request")
+	}
+}
+
+func TestEntryChangeIsNotRetried(t *testing.T) {
+	h := newHarness(t, harnessConfig{
+		slaves: 2,
+		retry:  handlers.RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond},
+		hedge:  handlers.HedgePolicy{Percentile: 95, MinDelay: 50 * time.Millisecond},
+	})
+	defer h.close()
+
+	h.fake.SetQueryEntry("leftTicket/queryZ")
+	// the entry is shared by every test, move back once done
+	defer func() {
+		h.fake.SetQueryEntry(fake12306.DefaultQueryEntry)
+		h.query(travelDate(2))
+	}()
+
+	if _, cache := h.query(travelDate(1)); cache != "MISS" {
+		t.Error("expected live tickets from the moved entry, got ", cache)
+	}
+	// one c_url reply, then the tickets at the new entry
+	if h.fake.Requests() != 2 {
+		t.Error("expected 2 upstream requests, got ", h.fake.Requests())
+	}
+	if n := h.slaves[0].Tasks() + h.slaves[1].Tasks(); n != 2 {
+		t.Error("expected 2 slave tasks, got ", n)
+	}
+}
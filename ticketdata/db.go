@@ -3,6 +3,8 @@ package ticketdata
 import (
 	"database/sql"
 	_ "github.com/lib/pq"
+	"strings"
+	"sync"
 )
 
 type TicketInfo interface {
@@ -14,15 +16,55 @@ type TicketInfo interface {
 
 type DB struct {
 	*sql.DB
+	driver string
+
+	// prepared statements are kept for the lifetime of the DB, keyed by their query
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt
 }
 
 func NewDB(dataSourceName string) (*DB, error) {
-	db, err := sql.Open("postgres", dataSourceName)
+	return openDB("postgres", dataSourceName)
+}
+
+func openDB(driver, dataSourceName string) (*DB, error) {
+	db, err := sql.Open(driver, dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return &DB{DB: db, driver: driver, stmts: make(map[string]*sql.Stmt)}, nil
+}
+
+// prepare returns the cached prepared statement of query, preparing it on first use.
+func (db *DB) prepare(query string) (*sql.Stmt, error) {
+	db.stmtMu.Lock()
+	defer db.stmtMu.Unlock()
+
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
+
+// Open picks a storage backend from the data source name:
+// "memory" keeps everything in process, "sqlite3://<path>" (or "sqlite://<path>") uses a SQLite file,
+// anything else is handed to postgres as is.
+func Open(dataSourceName string) (TicketInfo, error) {
+	switch {
+	case dataSourceName == "memory" || dataSourceName == "mem://":
+		return NewMemDB(), nil
+	case strings.HasPrefix(dataSourceName, "sqlite3://"):
+		return NewSQLiteDB(strings.TrimPrefix(dataSourceName, "sqlite3://"))
+	case strings.HasPrefix(dataSourceName, "sqlite://"):
+		return NewSQLiteDB(strings.TrimPrefix(dataSourceName, "sqlite://"))
+	}
+	return NewDB(dataSourceName)
 }
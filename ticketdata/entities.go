@@ -5,6 +5,12 @@ import (
 	"time"
 )
 
+// column lists the Scan calls below depend on, see migrations/ for the schema
+const (
+	ticketColumns = "id, from_station, to_station, travel_date, content, update_time"
+	priceColumns  = "id, train_no, from_station_no, to_station_no, seat_types, content, update_time"
+)
+
 type TicketEntity struct {
 	Id         int64     `db:"id"`
 	From       string    `db:"from_station"`
@@ -26,23 +32,22 @@ type TicketPriceEntity struct {
 }
 
 func (db *DB) GetAlternativeTickets(t *TicketEntity) (*TicketEntity, error) {
-	stmt, err := db.Prepare("select * from tickets where id=(select max(id) as mid from tickets where from_station = $1 and to_station = $2)")
-	defer stmt.Close()
+	// never serve a train that already left
+	stmt, err := db.prepare("select " + ticketColumns + " from tickets where id=(select max(id) as mid from tickets where from_station = $1 and to_station = $2 and travel_date >= $3)")
 
 	if err != nil {
 		log.Error("failed to prepare sql statement: ", err, stmt)
 		return t, err
 	}
 
-	err = stmt.QueryRow(t.From, t.To).
+	err = stmt.QueryRow(t.From, t.To, time.Now().Format(dateLayout)).
 		Scan(&t.Id, &t.From, &t.To, &t.Date, &t.Content, &t.UpdateTime)
 
 	return t, err
 }
 
 func (db *DB) GetLeftTickets(t *TicketEntity) (*TicketEntity, error) {
-	stmt, err := db.Prepare("select * from tickets where from_station = $1 and to_station = $2 and travel_date = $3")
-	defer stmt.Close()
+	stmt, err := db.prepare("select " + ticketColumns + " from tickets where from_station = $1 and to_station = $2 and travel_date = $3")
 
 	if err != nil {
 		log.Error("failed to prepare sql statement: ", err, stmt)
@@ -60,8 +65,7 @@ func (db *DB) GetLeftTickets(t *TicketEntity) (*TicketEntity, error) {
 
 // SaveLeftTickets Save tickets info into database. insert or update, depending on the availability of this particular entry.
 func (db *DB) SaveLeftTickets(t *TicketEntity) error {
-	stmt, err := db.Prepare("insert into tickets (from_station, to_station, travel_date, content, update_time) values ($1, $2, $3, $4, now())")
-	defer stmt.Close()
+	stmt, err := db.prepare("insert into tickets (from_station, to_station, travel_date, content, update_time) values ($1, $2, $3, $4, current_timestamp)")
 	if err != nil {
 		log.Error("failed to prepare sql statement: ", err, stmt)
 		return err
@@ -71,8 +75,7 @@ func (db *DB) SaveLeftTickets(t *TicketEntity) error {
 	if err != nil {
 		log.Error("failed to execute sql statement: ", err, stmt)
 		// we try to update it
-		updateStmt, err := db.Prepare("update tickets set content = $1, update_time = now() where from_station = $2 and to_station = $3 and travel_date = $4")
-		defer updateStmt.Close()
+		updateStmt, err := db.prepare("update tickets set content = $1, update_time = current_timestamp where from_station = $2 and to_station = $3 and travel_date = $4")
 
 		if err != nil {
 			log.Error("failed to prepare sql statement: ", err, updateStmt)
@@ -86,8 +89,7 @@ func (db *DB) SaveLeftTickets(t *TicketEntity) error {
 }
 
 func (db *DB) GetTicketPrice(t *TicketPriceEntity) (*TicketPriceEntity, error) {
-	stmt, err := db.Prepare("select * from ticket_price where train_no = $1 and from_station_no = $2 and to_station_no = $3 and seat_types = $4")
-	defer stmt.Close()
+	stmt, err := db.prepare("select " + priceColumns + " from ticket_price where train_no = $1 and from_station_no = $2 and to_station_no = $3 and seat_types = $4")
 
 	if err != nil {
 		log.Error("failed to prepare sql statement: ", err, stmt)
@@ -102,8 +104,7 @@ func (db *DB) GetTicketPrice(t *TicketPriceEntity) (*TicketPriceEntity, error) {
 
 // insert or update
 func (db *DB) SaveTicketPrice(t *TicketPriceEntity) error {
-	stmt, err := db.Prepare("insert into ticket_price (train_no, from_station_no, to_station_no, seat_types, content, update_time) values ($1, $2, $3, $4, $5, now())")
-	defer stmt.Close()
+	stmt, err := db.prepare("insert into ticket_price (train_no, from_station_no, to_station_no, seat_types, content, update_time) values ($1, $2, $3, $4, $5, current_timestamp)")
 	if err != nil {
 		log.Error("failed to prepare sql statement: ", err, stmt)
 		return err
@@ -112,8 +113,7 @@ func (db *DB) SaveTicketPrice(t *TicketPriceEntity) error {
 	_, err = stmt.Exec(t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes, t.Content)
 	if err != nil {
 		// try update
-		updateStmt, err := db.Prepare("update ticket_price set content = $1, update_time = now() where train_no = $2 and from_station_no = $3 and to_station_no = $4 and seat_types = $5")
-		defer updateStmt.Close()
+		updateStmt, err := db.prepare("update ticket_price set content = $1, update_time = current_timestamp where train_no = $2 and from_station_no = $3 and to_station_no = $4 and seat_types = $5")
 
 		if err != nil {
 			log.Error("failed to prepare sql statement: ", err, updateStmt)
@@ -0,0 +1,183 @@
+package ticketdata
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// TicketSnapshot is one sample of the left tickets of a route, kept for analysis after the entry in tickets is overwritten.
+type TicketSnapshot struct {
+	Id          int64     `db:"id"`
+	From        string    `db:"from_station"`
+	To          string    `db:"to_station"`
+	Date        string    `db:"travel_date"`
+	Content     string    `db:"content"`
+	CaptureTime time.Time `db:"capture_time"`
+}
+
+// TicketHistory is implemented by the stores able to keep snapshots. Snapshots are only ever appended or purged.
+type TicketHistory interface {
+	SaveSnapshot(s *TicketSnapshot) error
+	GetSnapshots(from, to, date string) ([]*TicketSnapshot, error)
+	PurgeSnapshots(before time.Time) (int64, error)
+}
+
+// History samples saved left tickets into a TicketHistory: a route gets at most one snapshot per interval,
+// and snapshots older than retention are purged by Run.
+type History struct {
+	store     TicketHistory
+	interval  time.Duration
+	retention time.Duration
+
+	mu   sync.Mutex
+	last map[ticketKey]time.Time
+}
+
+func NewHistory(store TicketHistory, interval, retention time.Duration) *History {
+	return &History{
+		store:     store,
+		interval:  interval,
+		retention: retention,
+		last:      make(map[ticketKey]time.Time),
+	}
+}
+
+// Record stores t as a snapshot unless the route was sampled less than an interval ago.
+func (h *History) Record(t *TicketEntity) error {
+	now := time.Now().UTC()
+	k := ticketKey{t.From, t.To, t.Date}
+
+	h.mu.Lock()
+	if last, ok := h.last[k]; ok && now.Sub(last) < h.interval {
+		h.mu.Unlock()
+		return nil
+	}
+	h.last[k] = now
+	h.mu.Unlock()
+
+	return h.store.SaveSnapshot(&TicketSnapshot{From: t.From, To: t.To, Date: t.Date, Content: t.Content, CaptureTime: now})
+}
+
+// Timeline returns the snapshots of a route and travel date, oldest first.
+func (h *History) Timeline(from, to, date string) ([]*TicketSnapshot, error) {
+	return h.store.GetSnapshots(from, to, date)
+}
+
+// Purge drops the snapshots that fell out of the retention window.
+func (h *History) Purge() (int64, error) {
+	before := time.Now().UTC().Add(-h.retention)
+
+	h.mu.Lock()
+	for k, last := range h.last {
+		if last.Before(before) {
+			delete(h.last, k)
+		}
+	}
+	h.mu.Unlock()
+
+	return h.store.PurgeSnapshots(before)
+}
+
+// Run purges expired snapshots periodically, it never returns.
+func (h *History) Run() {
+	period := h.retention / 24
+	if period < time.Minute {
+		period = time.Minute
+	}
+	if period > time.Hour {
+		period = time.Hour
+	}
+	for range time.Tick(period) {
+		n, err := h.Purge()
+		if err != nil {
+			log.Error("failed to purge ticket snapshots: ", err)
+		} else if n > 0 {
+			log.Info("purged ", n, " expired ticket snapshots")
+		}
+	}
+}
+
+func (db *DB) SaveSnapshot(s *TicketSnapshot) error {
+	stmt, err := db.prepare("insert into ticket_snapshots (from_station, to_station, travel_date, content, capture_time) values ($1, $2, $3, $4, $5)")
+	if err != nil {
+		log.Error("failed to prepare sql statement: ", err)
+		return err
+	}
+
+	_, err = stmt.Exec(s.From, s.To, s.Date, s.Content, s.CaptureTime.UTC())
+	return err
+}
+
+func (db *DB) GetSnapshots(from, to, date string) ([]*TicketSnapshot, error) {
+	rows, err := db.Query("select id, from_station, to_station, travel_date, content, capture_time from ticket_snapshots where from_station = $1 and to_station = $2 and travel_date = $3 order by capture_time", from, to, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*TicketSnapshot
+	for rows.Next() {
+		s := new(TicketSnapshot)
+		if err = rows.Scan(&s.Id, &s.From, &s.To, &s.Date, &s.Content, &s.CaptureTime); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
+
+func (db *DB) PurgeSnapshots(before time.Time) (int64, error) {
+	res, err := db.Exec("delete from ticket_snapshots where capture_time < $1", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (db *MemDB) SaveSnapshot(s *TicketSnapshot) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.nextSnapshotID++
+	c := *s
+	c.Id = db.nextSnapshotID
+	k := ticketKey{s.From, s.To, s.Date}
+	db.snapshots[k] = append(db.snapshots[k], &c)
+	return nil
+}
+
+func (db *MemDB) GetSnapshots(from, to, date string) ([]*TicketSnapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var snapshots []*TicketSnapshot
+	for _, s := range db.snapshots[ticketKey{from, to, date}] {
+		c := *s
+		snapshots = append(snapshots, &c)
+	}
+	return snapshots, nil
+}
+
+func (db *MemDB) PurgeSnapshots(before time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int64
+	for k, list := range db.snapshots {
+		kept := list[:0]
+		for _, s := range list {
+			if s.CaptureTime.Before(before) {
+				n++
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(db.snapshots, k)
+		} else {
+			db.snapshots[k] = kept
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,192 @@
+package ticketdata
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Purger is implemented by the stores the janitor can clean up.
+// Tickets are purged by travel date (formatted as 2006-01-02), prices by their last update.
+// With archive set, the rows are copied to the archive tables before being deleted.
+type Purger interface {
+	PurgeTickets(before string, archive bool) (int64, error)
+	PurgeTicketPrices(before time.Time, archive bool) (int64, error)
+}
+
+type JanitorConfig struct {
+	// how often the janitor runs
+	Interval time.Duration
+	// tickets are removed once their travel date is this many days in the past
+	TicketDays int
+	// prices not updated for this long are removed, 0 keeps them forever
+	PriceAge time.Duration
+	// move rows to the archive tables instead of dropping them
+	Archive bool
+}
+
+// JanitorStats tells what the janitor has done so far.
+type JanitorStats struct {
+	Runs         int64     `json:"runs"`
+	LastRun      time.Time `json:"last_run"`
+	LastTickets  int64     `json:"last_tickets"`
+	LastPrices   int64     `json:"last_prices"`
+	TotalTickets int64     `json:"total_tickets"`
+	TotalPrices  int64     `json:"total_prices"`
+	LastError    string    `json:"last_error,omitempty"`
+	Archive      bool      `json:"archive"`
+}
+
+// Janitor periodically removes tickets whose travel date has passed, and prices nobody refreshed for a while.
+type Janitor struct {
+	store Purger
+	cfg   JanitorConfig
+
+	mu    sync.Mutex
+	stats JanitorStats
+}
+
+func NewJanitor(store Purger, cfg JanitorConfig) *Janitor {
+	return &Janitor{
+		store: store,
+		cfg:   cfg,
+		stats: JanitorStats{Archive: cfg.Archive},
+	}
+}
+
+// RunOnce purges the expired rows right away and returns how many tickets and prices were removed.
+func (j *Janitor) RunOnce() (int64, int64, error) {
+	now := time.Now()
+	before := now.AddDate(0, 0, -j.cfg.TicketDays).Format(dateLayout)
+
+	tickets, err := j.store.PurgeTickets(before, j.cfg.Archive)
+	var prices int64
+	if err == nil && j.cfg.PriceAge > 0 {
+		prices, err = j.store.PurgeTicketPrices(now.Add(-j.cfg.PriceAge), j.cfg.Archive)
+	}
+
+	j.mu.Lock()
+	j.stats.Runs++
+	j.stats.LastRun = now
+	j.stats.LastTickets = tickets
+	j.stats.LastPrices = prices
+	j.stats.TotalTickets += tickets
+	j.stats.TotalPrices += prices
+	j.stats.LastError = ""
+	if err != nil {
+		j.stats.LastError = err.Error()
+	}
+	j.mu.Unlock()
+
+	return tickets, prices, err
+}
+
+// Run purges on every interval, it never returns.
+func (j *Janitor) Run() {
+	for {
+		tickets, prices, err := j.RunOnce()
+		if err != nil {
+			log.Error("janitor failed to purge expired entries: ", err)
+		} else {
+			log.Info("janitor removed ", tickets, " expired tickets and ", prices, " expired ticket prices")
+		}
+		time.Sleep(j.cfg.Interval)
+	}
+}
+
+func (j *Janitor) Stats() JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+func (db *DB) PurgeTickets(before string, archive bool) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if archive {
+		_, err = tx.Exec("insert into tickets_archive ("+ticketColumns+") select "+ticketColumns+" from tickets where travel_date < $1", before)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("delete from tickets where travel_date < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (db *DB) PurgeTicketPrices(before time.Time, archive bool) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	before = before.UTC()
+	if archive {
+		_, err = tx.Exec("insert into ticket_price_archive ("+priceColumns+") select "+priceColumns+" from ticket_price where update_time < $1", before)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("delete from ticket_price where update_time < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// ErrNoArchive is returned by stores that cannot archive what they purge.
+var ErrNoArchive = errors.New("the memory store has no archive")
+
+// PurgeTickets refuses to archive: nothing would ever read the archive of the memory store,
+// it would only grow.
+func (db *MemDB) PurgeTickets(before string, archive bool) (int64, error) {
+	if archive {
+		return 0, ErrNoArchive
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int64
+	for k := range db.tickets {
+		if k.date < before {
+			delete(db.tickets, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *MemDB) PurgeTicketPrices(before time.Time, archive bool) (int64, error) {
+	if archive {
+		return 0, ErrNoArchive
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int64
+	for k, v := range db.prices {
+		if v.UpdateTime.Before(before) {
+			delete(db.prices, k)
+			n++
+		}
+	}
+	return n, nil
+}
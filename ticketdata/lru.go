@@ -0,0 +1,212 @@
+package ticketdata
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// entry overhead on top of the content, a rough figure for the key strings, list element and map slot
+const lruEntryOverhead = 256
+
+type lruEntry struct {
+	key    interface{}
+	ticket *TicketEntity
+	price  *TicketPriceEntity
+	size   int64
+	stored time.Time
+}
+
+// LRUStats tells how well the in-memory layer does.
+type LRUStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// LRU is a memory bounded cache in front of another TicketInfo. Reads are served from memory when the entry
+// was stored less than ttl ago, writes go through to the backend first.
+// Only exact matches are cached: the alternative tickets the backend may return on a miss are not.
+type LRU struct {
+	backend  TicketInfo
+	maxBytes int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[interface{}]*list.Element
+	bytes int64
+
+	hits   int64
+	misses int64
+}
+
+func NewLRU(backend TicketInfo, maxBytes int64, ttl time.Duration) *LRU {
+	return &LRU{
+		backend:  backend,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[interface{}]*list.Element),
+	}
+}
+
+func (c *LRU) Stats() LRUStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return LRUStats{
+		Entries: c.ll.Len(),
+		Bytes:   c.bytes,
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+	}
+}
+
+func (c *LRU) get(key interface{}) *lruEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*lruEntry)
+	if time.Since(e.stored) > c.ttl {
+		c.removeElement(el)
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	return e
+}
+
+func (c *LRU) add(e *lruEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[e.key]; ok {
+		c.removeElement(el)
+	}
+	if e.size > c.maxBytes {
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	c.bytes += e.size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *LRU) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+func (c *LRU) addTickets(t *TicketEntity) {
+	copied := *t
+	c.add(&lruEntry{
+		key:    ticketKey{t.From, t.To, t.Date},
+		ticket: &copied,
+		size:   int64(len(t.Content)) + lruEntryOverhead,
+		stored: time.Now(),
+	})
+}
+
+func (c *LRU) addTicketPrice(t *TicketPriceEntity) {
+	copied := *t
+	c.add(&lruEntry{
+		key:    priceKey{t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes},
+		price:  &copied,
+		size:   int64(len(t.Content)) + lruEntryOverhead,
+		stored: time.Now(),
+	})
+}
+
+func (c *LRU) GetLeftTickets(t *TicketEntity) (*TicketEntity, error) {
+	if e := c.get(ticketKey{t.From, t.To, t.Date}); e != nil {
+		atomic.AddInt64(&c.hits, 1)
+		*t = *e.ticket
+		return t, nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	date := t.Date
+	_, err := c.backend.GetLeftTickets(t)
+	if err == nil && t.Date == date {
+		c.addTickets(t)
+	}
+	return t, err
+}
+
+func (c *LRU) SaveLeftTickets(t *TicketEntity) error {
+	if err := c.backend.SaveLeftTickets(t); err != nil {
+		return err
+	}
+	saved := *t
+	saved.UpdateTime = time.Now()
+	c.addTickets(&saved)
+	return nil
+}
+
+func (c *LRU) GetTicketPrice(t *TicketPriceEntity) (*TicketPriceEntity, error) {
+	if e := c.get(priceKey{t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes}); e != nil {
+		atomic.AddInt64(&c.hits, 1)
+		*t = *e.price
+		return t, nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	_, err := c.backend.GetTicketPrice(t)
+	if err == nil {
+		c.addTicketPrice(t)
+	}
+	return t, err
+}
+
+func (c *LRU) SaveTicketPrice(t *TicketPriceEntity) error {
+	if err := c.backend.SaveTicketPrice(t); err != nil {
+		return err
+	}
+	saved := *t
+	saved.UpdateTime = time.Now()
+	c.addTicketPrice(&saved)
+	return nil
+}
+
+// PurgeTickets purges the backend, which must be a Purger, and drops the purged tickets from memory
+// so that they are not served until the ttl runs out.
+func (c *LRU) PurgeTickets(before string, archive bool) (int64, error) {
+	p, ok := c.backend.(Purger)
+	if !ok {
+		return 0, errors.New("the storage behind the memory layer does not support purging")
+	}
+	n, err := p.PurgeTickets(before, archive)
+	c.drop(func(e *lruEntry) bool { return e.ticket != nil && e.ticket.Date < before })
+	return n, err
+}
+
+func (c *LRU) PurgeTicketPrices(before time.Time, archive bool) (int64, error) {
+	p, ok := c.backend.(Purger)
+	if !ok {
+		return 0, errors.New("the storage behind the memory layer does not support purging")
+	}
+	n, err := p.PurgeTicketPrices(before, archive)
+	c.drop(func(e *lruEntry) bool { return e.price != nil && e.price.UpdateTime.Before(before) })
+	return n, err
+}
+
+// drop removes the entries purged says so
+func (c *LRU) drop(purged func(*lruEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if purged(el.Value.(*lruEntry)) {
+			c.removeElement(el)
+		}
+		el = next
+	}
+}
@@ -0,0 +1,94 @@
+package ticketdata
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUWriteThrough(t *testing.T) {
+	backend := NewMemDB()
+	c := NewLRU(backend, 1<<20, time.Minute)
+
+	e := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10", Content: "content"}
+	if err := c.SaveLeftTickets(&e); err != nil {
+		t.Fatal(err)
+	}
+	stored := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10"}
+	if _, err := backend.GetLeftTickets(&stored); err != nil || stored.Content != "content" {
+		t.Fatal("expected the entry to be written to the backend, got ", stored, err)
+	}
+
+	got := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10"}
+	if _, err := c.GetLeftTickets(&got); err != nil || got.Content != "content" {
+		t.Fatal("expected a cached entry, got ", got, err)
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 0 {
+		t.Error("expected the read to hit memory, got ", s)
+	}
+
+	// alternatives coming from the backend are not cached under the requested date
+	alt := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-11"}
+	if _, err := c.GetLeftTickets(&alt); err != nil || alt.Date != "2099-02-10" {
+		t.Fatal("expected the alternative entry, got ", alt, err)
+	}
+	if s := c.Stats(); s.Entries != 1 {
+		t.Error("alternative entry should not be cached, got ", s)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	content := strings.Repeat("x", 1000)
+	c := NewLRU(NewMemDB(), 3*(1000+lruEntryOverhead), time.Minute)
+
+	for _, date := range []string{"2099-02-01", "2099-02-02", "2099-02-03"} {
+		c.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: date, Content: content})
+	}
+	// touch the oldest one so the second becomes the least recently used
+	c.GetLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-01"})
+	c.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-04", Content: content})
+
+	if _, ok := c.items[ticketKey{"BJP", "SHH", "2099-02-02"}]; ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if _, ok := c.items[ticketKey{"BJP", "SHH", "2099-02-01"}]; !ok {
+		t.Error("expected the recently used entry to stay")
+	}
+	if s := c.Stats(); s.Bytes > c.maxBytes {
+		t.Error("cache grew over its bound: ", s)
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	c := NewLRU(NewMemDB(), 1<<20, time.Millisecond)
+	c.SaveTicketPrice(&TicketPriceEntity{TrainNo: "1", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9", Content: "p"})
+	time.Sleep(2 * time.Millisecond)
+
+	got := TicketPriceEntity{TrainNo: "1", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9"}
+	if _, err := c.GetTicketPrice(&got); err != nil || got.Content != "p" {
+		t.Fatal("expected the price from the backend, got ", got, err)
+	}
+	if s := c.Stats(); s.Misses != 1 {
+		t.Error("expired entry should be a miss, got ", s)
+	}
+}
+
+func TestLRUPurgeForgetsPurgedRows(t *testing.T) {
+	backend := NewMemDB()
+	c := NewLRU(backend, 1<<20, time.Minute)
+	c.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-11", Content: "passed"})
+	c.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-11", Content: "ahead"})
+
+	j := NewJanitor(c, JanitorConfig{TicketDays: 1})
+	if tickets, _, err := j.RunOnce(); err != nil || tickets != 1 {
+		t.Fatal("unexpected purge result: ", tickets, err)
+	}
+	if s := c.Stats(); s.Entries != 1 {
+		t.Error("expected the purged ticket to leave memory, got ", s)
+	}
+	// the backend gives the other date of the route instead
+	got := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-11"}
+	if _, err := c.GetLeftTickets(&got); err == nil && got.Content == "passed" {
+		t.Error("expected the purged ticket to be gone, got ", got.Content)
+	}
+}
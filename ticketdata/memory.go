@@ -0,0 +1,132 @@
+package ticketdata
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+type ticketKey struct {
+	from, to, date string
+}
+
+type priceKey struct {
+	trainNo, fromNo, toNo, seatTypes string
+}
+
+// MemDB keeps tickets and ticket prices in process memory. It implements TicketInfo
+// and is meant for development, CI and small boxes that run without a database.
+type MemDB struct {
+	mu        sync.RWMutex
+	tickets   map[ticketKey]*TicketEntity
+	prices    map[priceKey]*TicketPriceEntity
+	snapshots map[ticketKey][]*TicketSnapshot
+
+	nextTicketID   int64
+	nextPriceID    int64
+	nextSnapshotID int64
+}
+
+func NewMemDB() *MemDB {
+	return &MemDB{
+		tickets:   make(map[ticketKey]*TicketEntity),
+		prices:    make(map[priceKey]*TicketPriceEntity),
+		snapshots: make(map[ticketKey][]*TicketSnapshot),
+	}
+}
+
+// GetAlternativeTickets returns the most recently inserted entry of the same route, skipping travel dates already passed.
+func (db *MemDB) GetAlternativeTickets(t *TicketEntity) (*TicketEntity, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	today := time.Now().Format(dateLayout)
+	var found *TicketEntity
+	for k, v := range db.tickets {
+		if k.from != t.From || k.to != t.To || k.date < today {
+			continue
+		}
+		if found == nil || v.Id > found.Id {
+			found = v
+		}
+	}
+	if found == nil {
+		return t, sql.ErrNoRows
+	}
+	*t = *found
+	return t, nil
+}
+
+func (db *MemDB) GetLeftTickets(t *TicketEntity) (*TicketEntity, error) {
+	db.mu.RLock()
+	v, ok := db.tickets[ticketKey{t.From, t.To, t.Date}]
+	if ok {
+		*t = *v
+	}
+	db.mu.RUnlock()
+
+	if !ok {
+		// same as DB: serve whatever we have for this route
+		return db.GetAlternativeTickets(t)
+	}
+	return t, nil
+}
+
+// SaveLeftTickets insert or update, depending on the availability of this particular entry.
+func (db *MemDB) SaveLeftTickets(t *TicketEntity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k := ticketKey{t.From, t.To, t.Date}
+	if v, ok := db.tickets[k]; ok {
+		v.Content = t.Content
+		v.UpdateTime = time.Now()
+		return nil
+	}
+	db.nextTicketID++
+	db.tickets[k] = &TicketEntity{
+		Id:         db.nextTicketID,
+		From:       t.From,
+		To:         t.To,
+		Date:       t.Date,
+		Content:    t.Content,
+		UpdateTime: time.Now(),
+	}
+	return nil
+}
+
+func (db *MemDB) GetTicketPrice(t *TicketPriceEntity) (*TicketPriceEntity, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.prices[priceKey{t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes}]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	*t = *v
+	return t, nil
+}
+
+// SaveTicketPrice insert or update
+func (db *MemDB) SaveTicketPrice(t *TicketPriceEntity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k := priceKey{t.TrainNo, t.FromStationNo, t.ToStationNo, t.SeatTypes}
+	if v, ok := db.prices[k]; ok {
+		v.Content = t.Content
+		v.UpdateTime = time.Now()
+		return nil
+	}
+	db.nextPriceID++
+	db.prices[k] = &TicketPriceEntity{
+		Id:            db.nextPriceID,
+		TrainNo:       t.TrainNo,
+		FromStationNo: t.FromStationNo,
+		ToStationNo:   t.ToStationNo,
+		SeatTypes:     t.SeatTypes,
+		Content:       t.Content,
+		UpdateTime:    time.Now(),
+	}
+	return nil
+}
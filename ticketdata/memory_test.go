@@ -0,0 +1,99 @@
+package ticketdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemDBSaveAndGet(t *testing.T) {
+	db := NewMemDB()
+	e := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-10", Content: "first"}
+	if err := db.SaveLeftTickets(&e); err != nil {
+		t.Fatal(err)
+	}
+	e.Content = "second"
+	if err := db.SaveLeftTickets(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	got := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-10"}
+	if _, err := db.GetLeftTickets(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "second" || got.Id != 1 {
+		t.Error("expected the entry to be updated in place, got ", got)
+	}
+}
+
+func TestMemDBAlternativeTickets(t *testing.T) {
+	db := NewMemDB()
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(dateLayout)
+	db.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: time.Now().Format(dateLayout), Content: "old"})
+	db.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: tomorrow, Content: "new"})
+	db.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-11", Content: "passed"})
+
+	got := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-12"}
+	if _, err := db.GetLeftTickets(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "new" || got.Date != tomorrow {
+		t.Error("expected the latest entry of the route, got ", got)
+	}
+
+	missing := TicketEntity{From: "BJP", To: "GZQ", Date: "2018-02-12"}
+	if _, err := db.GetLeftTickets(&missing); err == nil {
+		t.Error("expected an error for an unknown route")
+	}
+
+	p := TicketPriceEntity{TrainNo: "1", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9"}
+	if _, err := db.GetTicketPrice(&p); err == nil {
+		t.Error("expected an error for an unknown price")
+	}
+}
+
+func TestHistorySampling(t *testing.T) {
+	db := NewMemDB()
+	h := NewHistory(db, time.Hour, time.Hour)
+
+	e := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-10", Content: "first"}
+	h.Record(&e)
+	e.Content = "second"
+	h.Record(&e)
+
+	snapshots, err := h.Timeline("BJP", "SHH", "2018-02-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Content != "first" {
+		t.Error("expected one snapshot within the sampling interval, got ", snapshots)
+	}
+
+	if n, _ := db.PurgeSnapshots(time.Now().Add(time.Minute)); n != 1 {
+		t.Error("expected the snapshot to be purged, purged ", n)
+	}
+}
+
+func TestJanitorPurgesPassedDates(t *testing.T) {
+	db := NewMemDB()
+	db.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-11", Content: "passed"})
+	db.SaveLeftTickets(&TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-11", Content: "ahead"})
+	db.SaveTicketPrice(&TicketPriceEntity{TrainNo: "1", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9"})
+
+	if _, _, err := NewJanitor(db, JanitorConfig{TicketDays: 1, Archive: true}).RunOnce(); err != ErrNoArchive {
+		t.Error("expected the memory store to refuse archiving, got ", err)
+	}
+
+	j := NewJanitor(db, JanitorConfig{Interval: time.Hour, TicketDays: 1, PriceAge: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	tickets, prices, err := j.RunOnce()
+	if err != nil || tickets != 1 || prices != 1 {
+		t.Fatal("unexpected purge result: ", tickets, prices, err)
+	}
+	c := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-11"}
+	if _, err = db.GetLeftTickets(&c); err != nil || c.Content != "ahead" {
+		t.Error("expected the ticket ahead to stay, got ", c.Content, err)
+	}
+	if s := j.Stats(); s.Runs != 1 || s.TotalTickets != 1 {
+		t.Error("unexpected janitor stats: ", s)
+	}
+}
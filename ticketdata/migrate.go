@@ -0,0 +1,97 @@
+package ticketdata
+
+import (
+	"embed"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema files live in migrations/<driver>/NNNN_description.sql, NNNN being the schema version they bring the database to.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	script  string
+}
+
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %s: %v", driver, err)
+	}
+
+	var ms []migration
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s does not start with a version number", name)
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version, name, string(b)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	return ms, nil
+}
+
+// SchemaVersion returns the latest migration applied to the database, 0 for a fresh one.
+func (db *DB) SchemaVersion() (int, error) {
+	if _, err := db.Exec("create table if not exists schema_migrations (version integer primary key, applied_at timestamp not null default current_timestamp)"); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("select coalesce(max(version), 0) from schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Migrate applies every schema file newer than the recorded version, each in its own transaction.
+// It returns the version the database ends up with.
+func (db *DB) Migrate() (int, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	ms, err := loadMigrations(db.driver)
+	if err != nil {
+		return current, err
+	}
+
+	for _, m := range ms {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return current, err
+		}
+		if _, err = tx.Exec(m.script); err != nil {
+			tx.Rollback()
+			return current, fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if _, err = tx.Exec("insert into schema_migrations (version) values ($1)", m.version); err != nil {
+			tx.Rollback()
+			return current, err
+		}
+		if err = tx.Commit(); err != nil {
+			return current, err
+		}
+		log.Info("applied schema migration ", m.name)
+		current = m.version
+	}
+	return current, nil
+}
@@ -0,0 +1,26 @@
+-- Queries rely on this exact column order and on the unique keys below:
+-- saving an entry first tries an insert and falls back to an update when the key is taken.
+create table if not exists tickets (
+	id serial primary key,
+	from_station varchar(16) not null,
+	to_station varchar(16) not null,
+	travel_date varchar(16) not null,
+	content text not null,
+	update_time timestamptz not null default now(),
+	unique (from_station, to_station, travel_date)
+);
+
+-- GetAlternativeTickets looks up the newest entry of a route
+create index if not exists tickets_route_idx on tickets (from_station, to_station, id);
+create index if not exists tickets_travel_date_idx on tickets (travel_date);
+
+create table if not exists ticket_price (
+	id serial primary key,
+	train_no varchar(32) not null,
+	from_station_no varchar(8) not null,
+	to_station_no varchar(8) not null,
+	seat_types varchar(32) not null,
+	content text not null,
+	update_time timestamptz not null default now(),
+	unique (train_no, from_station_no, to_station_no, seat_types)
+);
@@ -0,0 +1,19 @@
+-- Where the janitor moves expired rows when archiving is turned on, same columns as the live tables
+create table if not exists tickets_archive (
+	id integer primary key,
+	from_station varchar(16) not null,
+	to_station varchar(16) not null,
+	travel_date varchar(16) not null,
+	content text not null,
+	update_time timestamptz not null
+);
+
+create table if not exists ticket_price_archive (
+	id integer primary key,
+	train_no varchar(32) not null,
+	from_station_no varchar(8) not null,
+	to_station_no varchar(8) not null,
+	seat_types varchar(32) not null,
+	content text not null,
+	update_time timestamptz not null
+);
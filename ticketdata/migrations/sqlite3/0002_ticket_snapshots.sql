@@ -0,0 +1,12 @@
+-- Append-only history of left ticket results, one row per sample
+create table if not exists ticket_snapshots (
+	id integer primary key autoincrement,
+	from_station text not null,
+	to_station text not null,
+	travel_date text not null,
+	content text not null,
+	capture_time timestamp not null
+);
+
+create index if not exists ticket_snapshots_route_idx on ticket_snapshots (from_station, to_station, travel_date, capture_time);
+create index if not exists ticket_snapshots_capture_time_idx on ticket_snapshots (capture_time);
@@ -0,0 +1,19 @@
+-- Where the janitor moves expired rows when archiving is turned on, same columns as the live tables
+create table if not exists tickets_archive (
+	id integer primary key,
+	from_station text not null,
+	to_station text not null,
+	travel_date text not null,
+	content text not null,
+	update_time timestamp not null
+);
+
+create table if not exists ticket_price_archive (
+	id integer primary key,
+	train_no text not null,
+	from_station_no text not null,
+	to_station_no text not null,
+	seat_types text not null,
+	content text not null,
+	update_time timestamp not null
+);
@@ -0,0 +1,17 @@
+package ticketdata
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteDB opens (or creates) a SQLite database file holding the tickets and ticket_price tables.
+// The returned DB shares its queries with the postgres one, run Migrate to create the schema.
+func NewSQLiteDB(path string) (*DB, error) {
+	db, err := openDB("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer, let database/sql queue them up instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
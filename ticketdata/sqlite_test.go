@@ -0,0 +1,84 @@
+package ticketdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQLiteInsertOrUpdate(t *testing.T) {
+	info, err := Open("sqlite3://:memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.(*DB)
+	defer db.Close()
+
+	version, err := db.Migrate()
+	if err != nil || version == 0 {
+		t.Fatal("failed to migrate: ", version, err)
+	}
+	if again, err := db.Migrate(); err != nil || again != version {
+		t.Fatal("migrating twice should be a no-op: ", again, err)
+	}
+
+	e := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-10", Content: "first"}
+	if err = db.SaveLeftTickets(&e); err != nil {
+		t.Fatal(err)
+	}
+	e.Content = "second"
+	if err = db.SaveLeftTickets(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	got := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-10"}
+	if _, err = db.GetLeftTickets(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "second" || got.UpdateTime.IsZero() {
+		t.Error("expected the entry to be updated in place, got ", got)
+	}
+
+	passed := TicketEntity{From: "BJP", To: "SHH", Date: "2018-02-11"}
+	if _, err = db.GetLeftTickets(&passed); err == nil {
+		t.Error("should not serve a travel date already passed, got ", passed)
+	}
+	future := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-10", Content: "future"}
+	if err = db.SaveLeftTickets(&future); err != nil {
+		t.Fatal(err)
+	}
+	alt := TicketEntity{From: "BJP", To: "SHH", Date: "2099-02-11"}
+	if _, err = db.GetLeftTickets(&alt); err != nil || alt.Date != "2099-02-10" {
+		t.Error("expected the alternative entry of the route, got ", alt, err)
+	}
+	if n, err := db.PurgeTickets("2019-01-01", true); err != nil || n != 1 {
+		t.Error("expected the passed entry to be purged, purged ", n, err)
+	}
+
+	p := TicketPriceEntity{TrainNo: "760000D63803", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9", Content: "{}"}
+	if err = db.SaveTicketPrice(&p); err != nil {
+		t.Fatal(err)
+	}
+	p.Content = `{"status":true}`
+	if err = db.SaveTicketPrice(&p); err != nil {
+		t.Fatal(err)
+	}
+	gotPrice := TicketPriceEntity{TrainNo: "760000D63803", FromStationNo: "01", ToStationNo: "05", SeatTypes: "OM9"}
+	if _, err = db.GetTicketPrice(&gotPrice); err != nil || gotPrice.Content != `{"status":true}` {
+		t.Error("expected the updated price, got ", gotPrice, err)
+	}
+
+	h := NewHistory(db, time.Hour, time.Hour)
+	if err = h.Record(&e); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := h.Timeline("BJP", "SHH", "2018-02-10")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Content != "second" {
+		t.Fatal("expected one snapshot, got ", snapshots, err)
+	}
+	if n, err := db.PurgeSnapshots(time.Now().Add(-time.Minute)); err != nil || n != 0 {
+		t.Error("fresh snapshot should survive a purge, purged ", n, err)
+	}
+	if n, err := db.PurgeSnapshots(time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Error("expected the snapshot to be purged, purged ", n, err)
+	}
+}
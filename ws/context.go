@@ -24,41 +24,119 @@ type WSContext struct {
 	unregister chan *Slave
 
 	// To signal the run goroutine to pick one slave
-	one chan bool
+	one chan pickReq
 
 	// picked slave
 	picked chan *Slave
 
+	// asks the run goroutine for the status of every slave
+	statusReq chan chan []SlaveStatus
+
 	// whether master takes requests
 	masterWork bool
+
+	// how long a slave has to answer a task
+	taskTimeout time.Duration
+
+	// picks the slave a task goes to
+	selector Selector
+
+	// slaves are pinged every heartbeat, and dropped once they missed missedBeats pongs in a row
+	heartbeat   time.Duration
+	missedBeats int
 }
 
 func NewWSContext(mw bool) *WSContext {
 	return &WSContext{
-		slaves:     make(map[*Slave]bool),
-		slaveList:  make([]*Slave, 0, 20),
-		register:   make(chan *Slave),
-		unregister: make(chan *Slave),
-		one:        make(chan bool),
-		picked:     make(chan *Slave),
-		masterWork: mw,
+		slaves:      make(map[*Slave]bool),
+		slaveList:   make([]*Slave, 0, 20),
+		register:    make(chan *Slave),
+		unregister:  make(chan *Slave),
+		one:         make(chan pickReq),
+		picked:      make(chan *Slave),
+		statusReq:   make(chan chan []SlaveStatus),
+		masterWork:  mw,
+		taskTimeout: 10 * time.Second,
+		selector:    Random{},
+		heartbeat:   10 * time.Second,
+		missedBeats: 3,
+	}
+}
+
+// SetHeartbeat sets how often slaves are pinged and how many pongs in a row they may miss before being
+// unregistered. A zero interval turns heartbeats off. It must be called before any slave registers.
+func (w *WSContext) SetHeartbeat(interval time.Duration, missed int) {
+	if missed < 1 {
+		missed = 1
 	}
+	w.heartbeat = interval
+	w.missedBeats = missed
+}
+
+// SetSelector sets how slaves are picked, it must be called before Run.
+func (w *WSContext) SetSelector(s Selector) {
+	w.selector = s
+}
+
+// SetTaskTimeout sets how long a slave has to answer a task before it counts as timed out.
+// It must be called before any slave registers.
+func (w *WSContext) SetTaskTimeout(d time.Duration) {
+	w.taskTimeout = d
+}
+
+func (w *WSContext) TaskTimeout() time.Duration {
+	return w.taskTimeout
+}
+
+type pickReq struct {
+	// route key of the task, empty if it has none
+	key string
+	// pick among the slaves not tried yet, master never takes a share
+	other bool
+	tried []*Slave
 }
 
-func (w *WSContext) randomRetrieve() *Slave {
+// MasterWork tells whether master takes requests itself.
+func (w *WSContext) MasterWork() bool {
+	return w.masterWork
+}
+
+// retrieve picks a slave with the selector. When master works, it takes as many requests as a slave would
+// on average: nil is returned with a chance of one in the number of slaves plus one.
+func (w *WSContext) retrieve(key string) *Slave {
 	l := len(w.slaveList)
 	if l == 0 {
 		return nil
 	}
-	m := l
-	if w.masterWork {
-		m++
+	// master takes its share of the tasks, but not of the keyed ones a KeySelector places: they would leave their slave
+	if _, keyed := w.selector.(KeySelector); w.masterWork && (key == "" || !keyed) && rand.Intn(l+1) == l {
+		return nil
+	}
+	return w.selectFrom(key, w.slaveList)
+}
+
+func (w *WSContext) selectFrom(key string, candidates []*Slave) *Slave {
+	if ks, ok := w.selector.(KeySelector); ok && key != "" {
+		return ks.SelectKey(key, candidates)
+	}
+	return w.selector.Select(candidates)
+}
+
+func (w *WSContext) retrieveOther(key string, tried []*Slave) *Slave {
+	left := make([]*Slave, 0, len(w.slaveList))
+OUTSIDE:
+	for _, s := range w.slaveList {
+		for _, t := range tried {
+			if s == t {
+				continue OUTSIDE
+			}
+		}
+		left = append(left, s)
 	}
-	idx := rand.Intn(m)
-	if idx == l {
+	if len(left) == 0 {
 		return nil
 	}
-	return w.slaveList[idx]
+	return w.selectFrom(key, left)
 }
 
 func (w *WSContext) Run() {
@@ -70,29 +148,59 @@ func (w *WSContext) Run() {
 				log.Error("error: trying to register a registered slave")
 			} else {
 				log.Info("Registered a slave server ", s.conn.RemoteAddr())
-				s.status.Addr = s.conn.RemoteAddr().String()
 				w.slaves[s] = true
 				w.slaveList = append(w.slaveList, s)
 				sort.Sort(w.slaveList)
+				if t, ok := w.selector.(Tracker); ok {
+					t.Add(s)
+				}
 			}
 		case s := <-w.unregister:
 			if _, ok := w.slaves[s]; ok {
 				log.Info("Unregistered a slave server ", s.conn.RemoteAddr())
 				delete(w.slaves, s)
+				if t, ok := w.selector.(Tracker); ok {
+					t.Remove(s)
+				}
 				w.slaveList = make([]*Slave, 0, 20)
 				for key := range w.slaves {
 					w.slaveList = append(w.slaveList, key)
 				}
 				sort.Sort(w.slaveList)
 			}
-		case <-w.one:
-			w.picked <- w.randomRetrieve()
+		case resp := <-w.statusReq:
+			data := make([]SlaveStatus, 0, len(w.slaveList))
+			for _, slave := range w.slaveList {
+				data = append(data, slave.Status())
+			}
+			resp <- data
+		case req := <-w.one:
+			if req.other {
+				w.picked <- w.retrieveOther(req.key, req.tried)
+			} else {
+				w.picked <- w.retrieve(req.key)
+			}
 		}
 	}
 }
 
 func (w *WSContext) GetOneSlave() *Slave {
-	w.one <- true
+	return w.pick(pickReq{})
+}
+
+// GetSlaveFor picks a slave for a task with a route key, selectors routing by key send the same key to the same slave.
+func (w *WSContext) GetSlaveFor(key string) *Slave {
+	return w.pick(pickReq{key: key})
+}
+
+// GetOtherSlave picks a slave that is not in tried, nil if all of them were tried.
+// key is the route key of the task, empty if it has none.
+func (w *WSContext) GetOtherSlave(key string, tried []*Slave) *Slave {
+	return w.pick(pickReq{key: key, other: true, tried: tried})
+}
+
+func (w *WSContext) pick(req pickReq) *Slave {
+	w.one <- req
 
 	select {
 	case s := <-w.picked:
@@ -120,11 +228,15 @@ func WSConnHandle(ctx *WSContext, w http.ResponseWriter, r *http.Request) {
 	slave.run()
 }
 
+// Status returns the status of every registered slave, in address order.
+func (w *WSContext) Status() []SlaveStatus {
+	resp := make(chan []SlaveStatus, 1)
+	w.statusReq <- resp
+	return <-resp
+}
+
 func WSStatusHandle(ctx *WSContext, w http.ResponseWriter, r *http.Request) {
-	var data []*SlaveStatus
-	for _, slave := range ctx.slaveList {
-		data = append(data, &(slave.status))
-	}
+	data := ctx.Status()
 
 	bts, err := json.Marshal(&data)
 	if err != nil {
@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// points each slave takes on the ring, more points spread the keys more evenly
+const hashReplicas = 128
+
+// ConsistentHash sends the tasks of a route key to the same slave, so that the slave keeps a warm session with
+// 12306 for the route and the queries of a route do not spread over every slave ip. When a slave joins or leaves,
+// only the keys of its share of the ring move. A key whose slave is not a candidate, because it was tried already,
+// goes to the next slave on the ring.
+// Tasks without a key are spread at random.
+type ConsistentHash struct {
+	hashes []uint32
+	owners map[uint32]*Slave
+	ids    map[*Slave]string
+}
+
+func NewConsistentHash() *ConsistentHash {
+	return &ConsistentHash{owners: make(map[uint32]*Slave), ids: make(map[*Slave]string)}
+}
+
+// identity names s by its host rather than its address, whose port changes on every reconnect, so that a slave
+// coming back gets the keys it had. Slaves sharing a host are told apart by the lowest number not in use.
+func (c *ConsistentHash) identity(s *Slave) string {
+	host := s.Status().Addr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	used := make(map[string]bool, len(c.ids))
+	for _, id := range c.ids {
+		used[id] = true
+	}
+	for n := 0; ; n++ {
+		if id := host + "/" + strconv.Itoa(n); !used[id] {
+			return id
+		}
+	}
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Add places s on the ring by its host.
+func (c *ConsistentHash) Add(s *Slave) {
+	if _, ok := c.ids[s]; ok {
+		return
+	}
+	id := c.identity(s)
+	c.ids[s] = id
+	for i := 0; i < hashReplicas; i++ {
+		h := hashKey(id + "#" + strconv.Itoa(i))
+		if _, ok := c.owners[h]; ok {
+			continue
+		}
+		c.owners[h] = s
+		c.hashes = append(c.hashes, h)
+	}
+	sort.Slice(c.hashes, func(i, j int) bool { return c.hashes[i] < c.hashes[j] })
+}
+
+func (c *ConsistentHash) Remove(s *Slave) {
+	delete(c.ids, s)
+	kept := c.hashes[:0]
+	for _, h := range c.hashes {
+		if c.owners[h] == s {
+			delete(c.owners, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	c.hashes = kept
+}
+
+func (c *ConsistentHash) Select(candidates []*Slave) *Slave {
+	return Random{}.Select(candidates)
+}
+
+func (c *ConsistentHash) SelectKey(key string, candidates []*Slave) *Slave {
+	if len(c.hashes) == 0 {
+		return c.Select(candidates)
+	}
+	allowed := make(map[*Slave]bool, len(candidates))
+	for _, s := range candidates {
+		allowed[s] = true
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(c.hashes), func(i int) bool { return c.hashes[i] >= h })
+	for i := 0; i < len(c.hashes); i++ {
+		if s := c.owners[c.hashes[(start+i)%len(c.hashes)]]; allowed[s] {
+			return s
+		}
+	}
+	// candidates not on the ring, should not happen
+	return c.Select(candidates)
+}
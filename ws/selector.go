@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Selector picks the slave a task goes to among the candidates, never an empty list.
+// It is only called from the Run goroutine of the context.
+type Selector interface {
+	Select(candidates []*Slave) *Slave
+}
+
+// KeySelector is a Selector that routes tasks by their route key.
+type KeySelector interface {
+	Selector
+	SelectKey(key string, candidates []*Slave) *Slave
+}
+
+// Tracker is a Selector told when slaves register and unregister.
+type Tracker interface {
+	Add(s *Slave)
+	Remove(s *Slave)
+}
+
+// Random picks any slave, the way slaves were always picked.
+type Random struct{}
+
+func (Random) Select(candidates []*Slave) *Slave {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// RoundRobin takes the slaves in turn, in address order.
+type RoundRobin struct {
+	next int
+}
+
+func (rr *RoundRobin) Select(candidates []*Slave) *Slave {
+	s := candidates[rr.next%len(candidates)]
+	rr.next++
+	return s
+}
+
+// LeastInFlight picks the slave with the fewest tasks waiting for an answer, one at random on ties
+// so that an idle pool does not send every task out of the same address.
+type LeastInFlight struct{}
+
+func (LeastInFlight) Select(candidates []*Slave) *Slave {
+	var best *Slave
+	var least int64
+	ties := 0
+	for _, s := range candidates {
+		n := s.InFlight()
+		switch {
+		case best == nil || n < least:
+			best, least, ties = s, n, 1
+		case n == least:
+			// keeps each of the tied slaves with the same chance
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = s
+			}
+		}
+	}
+	return best
+}
+
+// SuccessRate picks slaves at random, weighted by how many of their tasks succeeded.
+// New slaves start at a rate of one half so that they get a chance.
+type SuccessRate struct{}
+
+func successRate(s *Slave) float64 {
+	st := s.Status()
+	done := float64(st.TotalReq) - float64(st.Cancelled)
+	ok := done - float64(st.Failed)
+	return (ok + 1) / (done + 2)
+}
+
+func (SuccessRate) Select(candidates []*Slave) *Slave {
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, s := range candidates {
+		weights[i] = successRate(s)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// PowerOfTwo picks two slaves at random and keeps the one with the lower median task time.
+type PowerOfTwo struct{}
+
+func (PowerOfTwo) Select(candidates []*Slave) *Slave {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if b.Latency(50) < a.Latency(50) {
+		return b
+	}
+	return a
+}
+
+var selectors = map[string]func() Selector{
+	"random":          func() Selector { return Random{} },
+	"round-robin":     func() Selector { return &RoundRobin{} },
+	"least-in-flight": func() Selector { return LeastInFlight{} },
+	"success-rate":    func() Selector { return SuccessRate{} },
+	"p2c":             func() Selector { return PowerOfTwo{} },
+	"consistent-hash": func() Selector { return NewConsistentHash() },
+}
+
+// NewSelector returns the selector called name: random, round-robin, least-in-flight, success-rate, p2c or consistent-hash.
+func NewSelector(name string) (Selector, error) {
+	if f, ok := selectors[name]; ok {
+		return f(), nil
+	}
+	names := make([]string, 0, len(selectors))
+	for n := range selectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown slave selection %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// InFlight returns how many tasks of the slave are waiting for an answer.
+func (s *Slave) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
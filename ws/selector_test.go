@@ -0,0 +1,318 @@
+package ws
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSlaves(n int) []*Slave {
+	slaves := make([]*Slave, n)
+	for i := range slaves {
+		slaves[i] = &Slave{}
+	}
+	return slaves
+}
+
+func TestRoundRobin(t *testing.T) {
+	slaves := testSlaves(3)
+	rr := &RoundRobin{}
+	for i := 0; i < 6; i++ {
+		if s := rr.Select(slaves); s != slaves[i%3] {
+			t.Error("expected the slaves in turn, got another one at pick ", i)
+		}
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	slaves := testSlaves(3)
+	slaves[0].inFlight = 2
+	slaves[1].inFlight = 0
+	slaves[2].inFlight = 1
+	if s := (LeastInFlight{}).Select(slaves); s != slaves[1] {
+		t.Error("expected the idle slave")
+	}
+
+	// ties are spread over the least loaded slaves
+	slaves[0].inFlight = 0
+	picked := make(map[*Slave]int)
+	for i := 0; i < 300; i++ {
+		picked[(LeastInFlight{}).Select(slaves)]++
+	}
+	if len(picked) != 2 || picked[slaves[0]] < 100 || picked[slaves[1]] < 100 {
+		t.Error("expected the idle slaves to share the tasks, got ", picked[slaves[0]], " and ", picked[slaves[1]])
+	}
+}
+
+func TestSuccessRate(t *testing.T) {
+	slaves := testSlaves(2)
+	slaves[0].status = SlaveStatus{TotalReq: 100, Failed: 100}
+	slaves[1].status = SlaveStatus{TotalReq: 100}
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		if (SuccessRate{}).Select(slaves) == slaves[1] {
+			picked++
+		}
+	}
+	if picked < 950 {
+		t.Error("expected the reliable slave to take nearly every task, it took ", picked)
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	slaves := testSlaves(2)
+	slaves[0].addLatency(time.Second)
+	slaves[1].addLatency(10 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if s := (PowerOfTwo{}).Select(slaves); s != slaves[1] {
+			t.Error("expected the faster slave")
+		}
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	for name := range selectors {
+		if _, err := NewSelector(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := NewSelector("fastest"); err == nil {
+		t.Error("expected an unknown selection to be refused")
+	}
+}
+
+func ringSlaves(n int) []*Slave {
+	slaves := testSlaves(n)
+	for i, s := range slaves {
+		s.status.Addr = "10.0.0." + strconv.Itoa(i+1) + ":40000"
+	}
+	return slaves
+}
+
+func assign(c *ConsistentHash, slaves []*Slave, keys int) map[string]*Slave {
+	m := make(map[string]*Slave, keys)
+	for i := 0; i < keys; i++ {
+		k := "BJP|SHH|" + strconv.Itoa(i)
+		m[k] = c.SelectKey(k, slaves)
+	}
+	return m
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	slaves := ringSlaves(4)
+	c := NewConsistentHash()
+	for _, s := range slaves[:3] {
+		c.Add(s)
+	}
+	before := assign(c, slaves[:3], 3000)
+
+	c.Add(slaves[3])
+	after := assign(c, slaves, 3000)
+	moved := 0
+	for k, s := range before {
+		if after[k] != s {
+			moved++
+			if after[k] != slaves[3] {
+				t.Fatal("expected keys to move only to the new slave")
+			}
+		}
+	}
+	if moved == 0 || moved > 1200 {
+		t.Error("expected about a quarter of the keys to move, ", moved, " of 3000 did")
+	}
+
+	c.Remove(slaves[3])
+	for k, s := range assign(c, slaves[:3], 3000) {
+		if before[k] != s {
+			t.Fatal("expected the keys to go back where they were once the slave left")
+		}
+	}
+}
+
+func TestConsistentHashKeepsKeysOnReconnect(t *testing.T) {
+	slaves := ringSlaves(3)
+	// two slaves behind the same host
+	slaves[2].status.Addr = "10.0.0.1:40001"
+	c := NewConsistentHash()
+	for _, s := range slaves {
+		c.Add(s)
+	}
+	before := assign(c, slaves, 1000)
+	shares := make(map[*Slave]int)
+	for _, s := range before {
+		shares[s]++
+	}
+	if len(shares) != 3 {
+		t.Fatal("expected the slaves sharing a host to get their own keys, got ", len(shares), " owners")
+	}
+
+	// the slave comes back from another port
+	back := testSlaves(1)[0]
+	back.status.Addr = "10.0.0.2:41234"
+	c.Remove(slaves[1])
+	c.Add(back)
+	now := []*Slave{slaves[0], back, slaves[2]}
+	for k, s := range assign(c, now, 1000) {
+		if want := before[k]; want != s && !(want == slaves[1] && s == back) {
+			t.Fatal("expected the keys to stay where they were after a reconnect")
+		}
+	}
+}
+
+func TestMasterLeavesKeyedTasks(t *testing.T) {
+	slaves := ringSlaves(2)
+	c := NewConsistentHash()
+	for _, s := range slaves {
+		c.Add(s)
+	}
+	w := NewWSContext(true)
+	w.SetSelector(c)
+	w.slaveList = slaves
+	for i := 0; i < 100; i++ {
+		if w.retrieve("BJP|SHH|2099-02-10") == nil {
+			t.Fatal("expected keyed tasks to stay on the ring")
+		}
+	}
+	master := 0
+	for i := 0; i < 300; i++ {
+		if w.retrieve("") == nil {
+			master++
+		}
+	}
+	if master == 0 {
+		t.Error("expected master to keep its share of tasks without a key")
+	}
+}
+
+func TestConsistentHashFallsBackToNextNode(t *testing.T) {
+	slaves := ringSlaves(3)
+	c := NewConsistentHash()
+	for _, s := range slaves {
+		c.Add(s)
+	}
+	first := c.SelectKey("BJP|SHH|2099-02-10", slaves)
+	var others []*Slave
+	for _, s := range slaves {
+		if s != first {
+			others = append(others, s)
+		}
+	}
+	next := c.SelectKey("BJP|SHH|2099-02-10", others)
+	if next == first || next != c.SelectKey("BJP|SHH|2099-02-10", others) {
+		t.Error("expected the same other slave every time the first one fails")
+	}
+}
+
+// answer plays a slave on conn, answering every task right away
+func answer(conn *websocket.Conn) {
+	var mu sync.Mutex
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m Message
+		if Decode(data, &m) != nil || m.ID != TaskRequestType {
+			continue
+		}
+		body, _ := EncodeTaskResult(&TaskResult{Result: []byte("ok"), Code: RetrieveDataSuccessfully})
+		b, _ := Encode(&Message{ID: TaskResultType, TransID: m.TransID, Body: body})
+		mu.Lock()
+		conn.WriteMessage(websocket.BinaryMessage, b)
+		mu.Unlock()
+	}
+}
+
+// silent plays a slave on conn that takes tasks and never answers them
+func silent(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// connectedSlaves registers n slaves played by play with a running context
+func connectedSlaves(t *testing.T, n int, taskTimeout time.Duration, play func(*websocket.Conn)) ([]*Slave, func()) {
+	ctx := NewWSContext(false)
+	ctx.SetTaskTimeout(taskTimeout)
+	go ctx.Run()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WSConnHandle(ctx, w, r)
+	}))
+	var conns []*websocket.Conn
+	for i := 0; i < n; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		go play(conn)
+	}
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+		ts.Close()
+	}
+
+	seen := make(map[*Slave]bool)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(seen) < n {
+		if time.Now().After(deadline) {
+			closeAll()
+			t.Fatal("slaves did not register")
+		}
+		if s := ctx.GetOneSlave(); s != nil {
+			seen[s] = true
+		}
+	}
+	var slaves []*Slave
+	for s := range seen {
+		slaves = append(slaves, s)
+	}
+	return slaves, closeAll
+}
+
+func TestSelectWhileTasksRun(t *testing.T) {
+	slaves, closeAll := connectedSlaves(t, 3, 10*time.Second, answer)
+	defer closeAll()
+
+	var wg sync.WaitGroup
+	for _, s := range slaves {
+		wg.Add(1)
+		go func(s *Slave) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := s.DoTaskContext(context.Background(), "http://example.com/"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(s)
+	}
+
+	for i := 0; i < 200; i++ {
+		for name := range selectors {
+			sel, _ := NewSelector(name)
+			if s := sel.Select(slaves); s == nil {
+				t.Fatal(name, " picked no slave")
+			}
+		}
+		sort.Sort(SlaveSlice(slaves))
+	}
+	wg.Wait()
+
+	for _, s := range slaves {
+		if st := s.Status(); st.TotalReq != 50 || st.Failed != 0 {
+			t.Error("unexpected status ", st)
+		}
+	}
+}
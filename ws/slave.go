@@ -1,16 +1,26 @@
 package ws
 
 import (
+	"context"
 	"errors"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// how many recent task durations are kept for Latency
+const latencySamples = 64
+
 type writeJob struct {
 	data    *Message
 	resp    chan *Message
 	transID int64
+	// set by the bridge when the job was dropped before it got a transID
+	dropped bool
 }
 
 type SlaveStatus struct {
@@ -18,6 +28,8 @@ type SlaveStatus struct {
 	TotalReq    uint
 	Failed      uint
 	Timeout     uint
+	Cancelled   uint
+	Pending     int
 	AvgTime     int64
 	RunningTime int64
 }
@@ -26,12 +38,21 @@ type Slave struct {
 	ctx         *WSContext
 	conn        *websocket.Conn
 	in          chan *writeJob
+	cancel      chan *writeJob
 	out         chan *Message
 	toWrite     chan *writeJob
 	pendingJobs map[int64]*writeJob
 	nextTransID int64
 	exit        chan struct{}
-	status      SlaveStatus
+
+	// tasks waiting for an answer, updated atomically
+	inFlight int64
+
+	// guards the status and latencies, tasks update them while the context reads them to pick slaves
+	mu        sync.Mutex
+	status    SlaveStatus
+	latencies []time.Duration
+	nextIdx   int
 }
 
 func newSlave(w *WSContext, c *websocket.Conn) *Slave {
@@ -39,14 +60,23 @@ func newSlave(w *WSContext, c *websocket.Conn) *Slave {
 		ctx:         w,
 		conn:        c,
 		in:          make(chan *writeJob),
+		cancel:      make(chan *writeJob),
 		out:         make(chan *Message),
 		toWrite:     make(chan *writeJob),
 		pendingJobs: make(map[int64]*writeJob),
 		nextTransID: 0,
 		exit:        make(chan struct{}),
+		status:      SlaveStatus{Addr: c.RemoteAddr().String()},
 	}
 }
 
+// Status returns a copy of the counters of the slave.
+func (s *Slave) Status() SlaveStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
 func (s *Slave) run() {
 	go s.bridge()
 	go s.write()
@@ -54,12 +84,16 @@ func (s *Slave) run() {
 }
 
 func (s *Slave) bridge() {
-	pendingJobs := make(map[int64]*writeJob)
+	// only the bridge touches pendingJobs
+	pendingJobs := s.pendingJobs
 	log.Debug("bridge coroutine for ", s.conn.RemoteAddr(), " is running")
 OUTSIDE:
 	for {
 		select {
 		case job := <-s.in:
+			if job.dropped {
+				continue
+			}
 			job.transID = s.getNextTransID()
 			if _, ok := pendingJobs[job.transID]; ok {
 				panic("We already have this ID in pending jobs, but this cannot happen!")
@@ -67,6 +101,13 @@ OUTSIDE:
 				pendingJobs[job.transID] = job
 				s.toWrite <- job
 			}
+		case job := <-s.cancel:
+			if job.transID == 0 {
+				// not registered yet, make sure it never is
+				job.dropped = true
+			} else if pendingJobs[job.transID] == job {
+				delete(pendingJobs, job.transID)
+			}
 		case dataResp := <-s.out:
 			if job, ok := pendingJobs[dataResp.TransID]; ok {
 				job.resp <- dataResp
@@ -75,15 +116,31 @@ OUTSIDE:
 		case <-s.exit:
 			break OUTSIDE
 		}
+		s.mu.Lock()
+		s.status.Pending = len(pendingJobs)
+		s.mu.Unlock()
 	}
 	log.Debug("bridge coroutine for ", s.conn.RemoteAddr(), " exited")
 }
 
 func (s *Slave) write() {
 	log.Debug("write coroutine for ", s.conn.RemoteAddr(), " is running")
+
+	// pings stay off when there is no heartbeat interval, a nil channel never fires
+	var ping <-chan time.Time
+	if s.ctx.heartbeat > 0 {
+		ticker := time.NewTicker(s.ctx.heartbeat)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
 OUTSIDE:
 	for {
 		select {
+		case <-ping:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.ctx.heartbeat))
+			if err != nil {
+				log.Warn("failed to ping slave ", s.conn.RemoteAddr(), ": ", err)
+			}
 		case job := <-s.toWrite:
 			job.data.TransID = job.transID
 			b, err := Encode(job.data)
@@ -110,6 +167,14 @@ func (s *Slave) read() {
 		close(s.exit)
 	}()
 
+	// the slave answers pings with pongs, without any of them for missedBeats heartbeats it is taken as dead
+	if s.ctx.heartbeat > 0 {
+		s.extendDeadline()
+		s.conn.SetPongHandler(func(string) error {
+			return s.extendDeadline()
+		})
+	}
+
 	for {
 		t, data, err := s.conn.ReadMessage()
 		if t == websocket.BinaryMessage {
@@ -117,13 +182,29 @@ func (s *Slave) read() {
 		}
 
 		if err != nil {
-			log.Error("ws read error: ", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Warn("slave ", s.conn.RemoteAddr(), " missed ", s.ctx.missedBeats, " heartbeats, dropping it")
+			} else {
+				log.Error("ws read error: ", err)
+			}
 			break
 		}
+		if s.ctx.heartbeat > 0 {
+			s.extendDeadline()
+		}
 	}
 	log.Debug("read coroutine for ", s.conn.RemoteAddr(), " exited")
 }
 
+func (s *Slave) extendDeadline() error {
+	return s.conn.SetReadDeadline(time.Now().Add(s.ctx.heartbeat * time.Duration(s.ctx.missedBeats)))
+}
+
+// Addr is the remote address of the slave
+func (s *Slave) Addr() string {
+	return s.conn.RemoteAddr().String()
+}
+
 func (s *Slave) getNextTransID() int64 {
 	s.nextTransID++
 	return s.nextTransID
@@ -139,27 +220,60 @@ func (s *Slave) onMessage(data []byte) {
 	}
 }
 
-func (s *Slave) writeData(m *Message) (*Message, error) {
+func (s *Slave) writeData(ctx context.Context, m *Message) (*Message, error) {
 	job := writeJob{
 		data: m,
-		resp: make(chan *Message),
+		// buffered so that a late answer does not block the bridge once we stopped waiting
+		resp: make(chan *Message, 1),
 	}
 
+	// closed once we stop waiting, so that the sender does not hang around for a job nobody wants
+	giveUp := make(chan struct{})
+	defer close(giveUp)
 	go func() {
-		s.in <- &job
+		select {
+		case s.in <- &job:
+		case <-s.exit:
+		case <-ctx.Done():
+		case <-giveUp:
+		}
 	}()
 
 	select {
 	case msg := <-job.resp:
 		return msg, nil
-	case <-time.After(10 * time.Second):
-		s.status.Timeout++
+	case <-time.After(s.ctx.taskTimeout):
+		s.count(&s.status.Timeout)
+		s.drop(&job)
 		return nil, errors.New("timeout while waiting for response")
+	case <-s.exit:
+		return nil, errors.New("slave disconnected while waiting for response")
+	case <-ctx.Done():
+		s.drop(&job)
+		return nil, ctx.Err()
+	}
+}
+
+// drop removes job from the pending jobs, a late answer is then ignored
+func (s *Slave) drop(job *writeJob) {
+	select {
+	case s.cancel <- job:
+	case <-s.exit:
 	}
 }
 
 func (s *Slave) DoTask(url string) (*TaskResult, error) {
+	return s.DoTaskContext(context.Background(), url)
+}
+
+// DoTaskContext is DoTask giving up once ctx is done, the pending job is then dropped
+// and a late answer from the slave ignored.
+func (s *Slave) DoTaskContext(ctx context.Context, url string) (*TaskResult, error) {
+	s.mu.Lock()
 	s.status.TotalReq++
+	s.mu.Unlock()
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
 	start := time.Now()
 
 	t := Task{
@@ -176,15 +290,25 @@ func (s *Slave) DoTask(url string) (*TaskResult, error) {
 		Body: b,
 	}
 
-	resp, e := s.writeData(&m)
+	resp, e := s.writeData(ctx, &m)
+	if e != nil && ctx.Err() == context.Canceled {
+		s.count(&s.status.Cancelled)
+		return nil, e
+	}
+	if e != nil && ctx.Err() == context.DeadlineExceeded {
+		// the caller's deadline came before our own task timeout
+		s.count(&s.status.Timeout)
+		s.count(&s.status.Failed)
+		return nil, e
+	}
 	if e != nil {
-		log.Error("failed to write data: ", err)
-		s.status.Failed++
+		log.Error("failed to write data: ", e)
+		s.count(&s.status.Failed)
 		return nil, e
 	}
 
 	if resp.ID != TaskResultType {
-		s.status.Failed++
+		s.count(&s.status.Failed)
 		return nil, errors.New("Task result does not contain correct ID")
 	}
 
@@ -193,11 +317,55 @@ func (s *Slave) DoTask(url string) (*TaskResult, error) {
 	if e != nil {
 		log.Panic("failed to decode task result")
 	}
-	s.status.RunningTime += (time.Since(start).Nanoseconds() / (int64)(time.Millisecond))
-	s.status.AvgTime = s.status.RunningTime * 1.0 / (int64)(s.status.TotalReq-s.status.Failed)
+	elapsed := time.Since(start)
+	s.mu.Lock()
+	s.addLatency(elapsed)
+	s.status.RunningTime += (elapsed.Nanoseconds() / (int64)(time.Millisecond))
+	if done := s.status.TotalReq - s.status.Failed - s.status.Cancelled; done > 0 {
+		s.status.AvgTime = s.status.RunningTime * 1.0 / (int64)(done)
+	}
+	s.mu.Unlock()
 	return &tr, nil
 }
 
+func (s *Slave) count(counter *uint) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+// addLatency must be called with s.mu held
+func (s *Slave) addLatency(d time.Duration) {
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, d)
+		return
+	}
+	s.latencies[s.nextIdx] = d
+	s.nextIdx = (s.nextIdx + 1) % latencySamples
+}
+
+// Latency returns the p-th percentile (0-100) of how long the recent tasks took,
+// the average task time if the slave has not done any task yet.
+func (s *Slave) Latency(p float64) time.Duration {
+	s.mu.Lock()
+	sorted := append([]time.Duration{}, s.latencies...)
+	avg := s.status.AvgTime
+	s.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return time.Duration(avg) * time.Millisecond
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(p / 100 * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
 // sort support for slice of slaves
 type SlaveSlice []*Slave
 
@@ -206,12 +374,13 @@ func (ss SlaveSlice) Len() int { return len(ss) }
 func (ss SlaveSlice) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
 
 func (ss SlaveSlice) Less(i, j int) bool {
-	if ss[i].status.Addr < ss[j].status.Addr {
+	a, b := ss[i].Status(), ss[j].Status()
+	if a.Addr < b.Addr {
 		return true
 	}
-	if ss[i].status.Addr > ss[j].status.Addr {
+	if a.Addr > b.Addr {
 		return false
 	}
 
-	return ss[i].status.TotalReq < ss[j].status.TotalReq
+	return a.TotalReq < b.TotalReq
 }
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitNoPending(t *testing.T, s *Slave) {
+	deadline := time.Now().Add(time.Second)
+	for s.Status().Pending != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the dropped jobs to leave the pending jobs, ", s.Status().Pending, " left")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTimedOutJobIsDropped(t *testing.T) {
+	slaves, closeAll := connectedSlaves(t, 1, 50*time.Millisecond, silent)
+	defer closeAll()
+	s := slaves[0]
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.DoTask("http://example.com/"); err == nil {
+			t.Fatal("expected the silent slave to time out")
+		}
+	}
+	waitNoPending(t, s)
+	if st := s.Status(); st.Timeout != 3 {
+		t.Error("expected 3 timeouts, got ", st.Timeout)
+	}
+}
+
+func TestCancelledJobIsDropped(t *testing.T) {
+	slaves, closeAll := connectedSlaves(t, 1, 10*time.Second, silent)
+	defer closeAll()
+	s := slaves[0]
+
+	// cancelled before the job reaches the bridge, and while it waits for the answer
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 20; i++ {
+		if _, err := s.DoTaskContext(cancelled, "http://example.com/"); err != context.Canceled {
+			t.Fatal("expected the task to be cancelled, got ", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.DoTaskContext(ctx, "http://example.com/"); err != context.DeadlineExceeded {
+		t.Fatal("expected the task to give up, got ", err)
+	}
+	waitNoPending(t, s)
+	if st := s.Status(); st.Cancelled != 20 || st.Timeout != 1 {
+		t.Error("expected 20 cancelled tasks and a timeout, got ", st.Cancelled, " and ", st.Timeout)
+	}
+}